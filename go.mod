@@ -3,8 +3,12 @@ module git.quba.fr/qbarrand/quba.fr-server
 go 1.14
 
 require (
+	github.com/andybalholm/brotli v1.0.0
+	github.com/go-git/go-git/v5 v5.1.0
 	github.com/golang/mock v1.3.1
 	github.com/gorilla/mux v1.7.3
 	github.com/urfave/cli v1.21.0
+	golang.org/x/net v0.0.0-20200301022130-244492dfa37a
+	// Pinned: pkg/image/progress.go reads an unexported field of MagickWand
 	gopkg.in/gographics/imagick.v2 v2.6.0
 )
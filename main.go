@@ -1,33 +1,77 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/urfave/cli"
 
 	"git.quba.fr/qbarrand/quba.fr-server/pkg"
+	"git.quba.fr/qbarrand/quba.fr-server/pkg/handlers"
+	"git.quba.fr/qbarrand/quba.fr-server/pkg/image"
 )
 
 func main() {
 	var (
-		addr    string
-		dir     string
-		quality uint
+		addr            string
+		baseURL         string
+		exportFormats   string
+		exportSizes     string
+		cacheDir        string
+		cacheMaxBytes   int64
+		debugAddr       string
+		dir             string
+		drainTimeout    time.Duration
+		healthConfig    string
+		healthDNSExpect string
+		healthDNSName   string
+		healthDNSType   string
+		healthInterval  time.Duration
+		healthTimeout   time.Duration
+		idleTimeout     time.Duration
+		maxBodyBytes    int64
+		maxHeaderBytes  int
+		keepProfile     bool
+		metaPaths       string
+		metadata        string
+		outDir          string
+		protocol        string
+		quality         uint
+		readHdrTimeout  time.Duration
+		readTimeout     time.Duration
+		robotsDisallow  bool
+		robotsRules     string
+		shutdownDelay   time.Duration
+		sitemapExclude  string
+		sitemapImages   bool
+		sitemapInclude  string
+		sitemapRules    string
+		tlsCert         string
+		tlsKey          string
+		tlsRedirectAddr string
+		srgb            bool
+		warm            bool
+		warmConcurrency int
+		warmFormats     string
+		warmPresets     string
+		warmSizes       string
+		writeTimeout    time.Duration
 	)
 
 	app := cli.NewApp()
 
 	app.Name = "server"
 
-	app.Flags = []cli.Flag{
-		cli.StringFlag{
-			Name:        "addr",
-			Usage:       "the address and port on which this server should listen",
-			EnvVar:      "ADDR",
-			Value:       ":8080",
-			Destination: &addr,
-		},
+	// Flags configuring how images are rendered, shared by all commands
+	imageFlags := []cli.Flag{
 		cli.StringFlag{
 			Name:        "dir",
 			Usage:       "path to the served directory",
@@ -35,6 +79,19 @@ func main() {
 			Value:       ".",
 			Destination: &dir,
 		},
+		cli.BoolFlag{
+			Name:        "keep-icc-profile",
+			Usage:       "embed a compact sRGB ICC profile in converted images",
+			EnvVar:      "KEEP_ICC_PROFILE",
+			Destination: &keepProfile,
+		},
+		cli.StringFlag{
+			Name:        "metadata",
+			Usage:       "metadata left in served images: strip, copyright or keep",
+			EnvVar:      "METADATA",
+			Value:       "strip",
+			Destination: &metadata,
+		},
 		cli.UintFlag{
 			Name:        "quality",
 			Usage:       "quality of the output JPG file",
@@ -43,16 +100,557 @@ func main() {
 			Value:       80,
 			Destination: &quality,
 		},
+		cli.BoolTFlag{
+			Name:        "srgb",
+			Usage:       "convert images to sRGB using their embedded ICC profile",
+			EnvVar:      "SRGB",
+			Destination: &srgb,
+		},
+	}
+
+	// Flags shared by the server and the warm command
+	warmFlags := []cli.Flag{
+		cli.StringFlag{
+			Name:        "cache-dir",
+			Usage:       "directory where rendered images are cached; disabled if empty",
+			EnvVar:      "CACHE_DIR",
+			Destination: &cacheDir,
+		},
+		cli.Int64Flag{
+			Name:        "cache-max-bytes",
+			Usage:       "size of --cache-dir above which the least recently used images are removed; unlimited if 0",
+			EnvVar:      "CACHE_MAX_BYTES",
+			Value:       1 << 30,
+			Destination: &cacheMaxBytes,
+		},
+		cli.IntFlag{
+			Name:        "warm-concurrency",
+			Usage:       "number of images rendered in parallel while warming up",
+			EnvVar:      "WARM_CONCURRENCY",
+			Value:       runtime.NumCPU(),
+			Destination: &warmConcurrency,
+		},
+		cli.StringFlag{
+			Name:        "warm-formats",
+			Usage:       "comma-separated formats rendered while warming up, among jpg, jxr and webp",
+			EnvVar:      "WARM_FORMATS",
+			Value:       "jpg,webp",
+			Destination: &warmFormats,
+		},
+		cli.StringFlag{
+			Name:        "warm-presets",
+			Usage:       "comma-separated format:size variants rendered while warming up, e.g. webp:1920w",
+			EnvVar:      "WARM_PRESETS",
+			Destination: &warmPresets,
+		},
+		cli.StringFlag{
+			Name:        "warm-sizes",
+			Usage:       "comma-separated sizes rendered in every warm-up format: original, or a width or height such as 1920w or 1080h",
+			EnvVar:      "WARM_SIZES",
+			Value:       "original",
+			Destination: &warmSizes,
+		},
+	}
+
+	imageOptions := func() (handlers.ImageOptions, error) {
+		metadataPolicy, err := image.ParseMetadataPolicy(metadata)
+		if err != nil {
+			return handlers.ImageOptions{}, err
+		}
+
+		if cacheMaxBytes < 0 {
+			return handlers.ImageOptions{}, errors.New("--cache-max-bytes cannot be negative")
+		}
+
+		return handlers.ImageOptions{
+			CacheDir:      cacheDir,
+			CacheMaxBytes: cacheMaxBytes,
+			Colors: image.ColorOptions{
+				ConvertToSRGB: srgb,
+				KeepProfile:   keepProfile,
+			},
+			Metadata: metadataPolicy,
+			Quality:  quality,
+		}, nil
+	}
+
+	warmOptions := func() (pkg.WarmOptions, error) {
+		if cacheDir == "" {
+			return pkg.WarmOptions{}, errors.New("warming up requires --cache-dir")
+		}
+
+		variants, err := handlers.ParseVariants(splitList(warmFormats), splitList(warmSizes), splitList(warmPresets))
+		if err != nil {
+			return pkg.WarmOptions{}, err
+		}
+
+		return pkg.WarmOptions{
+			Concurrency: warmConcurrency,
+			Variants:    variants,
+		}, nil
+	}
+
+	healthRegistry := func() (*handlers.HealthRegistry, error) {
+		checks := []handlers.HealthCheck{
+			{Name: "dir", Check: handlers.DirReadableCheck(dir)},
+			{Name: "imagemagick", Check: handlers.ImageMagickCheck},
+		}
+
+		if cacheDir != "" {
+			checks = append(checks, handlers.HealthCheck{Name: "cache-dir", Check: handlers.DirWritableCheck(cacheDir)})
+		}
+
+		if healthDNSName != "" {
+			check, err := handlers.DNSCheck(healthDNSName, healthDNSType, healthDNSExpect)
+			if err != nil {
+				return nil, err
+			}
+
+			checks = append(checks, handlers.HealthCheck{Name: "dns", Check: check})
+		}
+
+		var timings map[string]handlers.HealthCheckTimings
+
+		if healthConfig != "" {
+			var err error
+
+			if timings, err = handlers.ReadHealthConfig(healthConfig); err != nil {
+				return nil, err
+			}
+		}
+
+		registry := &handlers.HealthRegistry{}
+
+		for _, c := range checks {
+			c.Interval = healthInterval
+			c.Timeout = healthTimeout
+
+			if t, ok := timings[c.Name]; ok {
+				if t.Interval != 0 {
+					c.Interval = t.Interval
+				}
+
+				if t.Timeout != 0 {
+					c.Timeout = t.Timeout
+				}
+
+				delete(timings, c.Name)
+			}
+
+			if err := registry.Register(c); err != nil {
+				return nil, err
+			}
+		}
+
+		for name := range timings {
+			return nil, fmt.Errorf("%s: unknown or disabled health check", name)
+		}
+
+		return registry, nil
 	}
 
+	app.Flags = append([]cli.Flag{
+		cli.StringFlag{
+			Name:        "addr",
+			Usage:       "the address on which this server should listen: host:port, unix:PATH, or systemd[:NAME] for socket activation",
+			EnvVar:      "ADDR",
+			Value:       ":8080",
+			Destination: &addr,
+		},
+		cli.StringFlag{
+			Name:        "base-url",
+			Usage:       "URL at which the served directory is published, used in the sitemap and robots.txt",
+			EnvVar:      "BASE_URL",
+			Value:       "https://quba.fr",
+			Destination: &baseURL,
+		},
+		cli.StringFlag{
+			Name:        "debug-addr",
+			Usage:       "address of a private listener serving the expvar metrics on /debug/vars, with the syntax of --addr; disabled if empty",
+			EnvVar:      "DEBUG_ADDR",
+			Destination: &debugAddr,
+		},
+		cli.DurationFlag{
+			Name:        "drain-timeout",
+			Usage:       "time given to in-flight requests to complete on shutdown, after which they are cancelled",
+			EnvVar:      "DRAIN_TIMEOUT",
+			Value:       30 * time.Second,
+			Destination: &drainTimeout,
+		},
+		cli.StringFlag{
+			Name:        "health-config",
+			Usage:       "path to a JSON file setting the interval and timeout of health checks, e.g. [{\"name\": \"dns\", \"interval\": \"1m\", \"timeout\": \"2s\"}]",
+			EnvVar:      "HEALTH_CONFIG",
+			Destination: &healthConfig,
+		},
+		cli.StringFlag{
+			Name:        "health-dns-expected",
+			Usage:       "value that one of the records of the DNS health check should have; any if empty",
+			EnvVar:      "HEALTH_DNS_EXPECTED",
+			Value:       "quentin@quba.fr",
+			Destination: &healthDNSExpect,
+		},
+		cli.StringFlag{
+			Name:        "health-dns-name",
+			Usage:       "name looked up by the DNS health check; disabled if empty",
+			EnvVar:      "HEALTH_DNS_NAME",
+			Value:       "ping.quba.fr",
+			Destination: &healthDNSName,
+		},
+		cli.StringFlag{
+			Name:        "health-dns-type",
+			Usage:       "type of the records looked up by the DNS health check: A or TXT",
+			EnvVar:      "HEALTH_DNS_TYPE",
+			Value:       "TXT",
+			Destination: &healthDNSType,
+		},
+		cli.DurationFlag{
+			Name:        "health-interval",
+			Usage:       "default minimum time between two runs of a health check",
+			EnvVar:      "HEALTH_INTERVAL",
+			Value:       handlers.DefaultHealthInterval,
+			Destination: &healthInterval,
+		},
+		cli.DurationFlag{
+			Name:        "health-timeout",
+			Usage:       "default timeout of a health check",
+			EnvVar:      "HEALTH_TIMEOUT",
+			Value:       handlers.DefaultHealthTimeout,
+			Destination: &healthTimeout,
+		},
+		cli.DurationFlag{
+			Name:        "idle-timeout",
+			Usage:       "time a keep-alive connection may wait for the next request",
+			EnvVar:      "IDLE_TIMEOUT",
+			Value:       2 * time.Minute,
+			Destination: &idleTimeout,
+		},
+		cli.Int64Flag{
+			Name:        "max-body-bytes",
+			Usage:       "maximum size of a request body, 0 for no limit",
+			EnvVar:      "MAX_BODY_BYTES",
+			Value:       1 << 20,
+			Destination: &maxBodyBytes,
+		},
+		cli.IntFlag{
+			Name:        "max-header-bytes",
+			Usage:       "maximum size of the request headers",
+			EnvVar:      "MAX_HEADER_BYTES",
+			Value:       64 << 10,
+			Destination: &maxHeaderBytes,
+		},
+		cli.StringFlag{
+			Name:        "meta-headers-paths",
+			Usage:       "comma-separated URL path prefixes whose images always carry the X-* metadata headers, instead of only on ?meta=1 or Prefer: meta",
+			EnvVar:      "META_HEADERS_PATHS",
+			Destination: &metaPaths,
+		},
+		cli.StringFlag{
+			Name:        "protocol",
+			Usage:       "HTTP version: auto (HTTP/2 negotiated over TLS), http1, or h2c (HTTP/2 without TLS, with prior knowledge)",
+			EnvVar:      "PROTOCOL",
+			Value:       pkg.ProtocolAuto,
+			Destination: &protocol,
+		},
+		cli.DurationFlag{
+			Name:        "read-header-timeout",
+			Usage:       "time allowed to read the request headers",
+			EnvVar:      "READ_HEADER_TIMEOUT",
+			Value:       10 * time.Second,
+			Destination: &readHdrTimeout,
+		},
+		cli.DurationFlag{
+			Name:        "read-timeout",
+			Usage:       "time allowed to read the whole request",
+			EnvVar:      "READ_TIMEOUT",
+			Value:       30 * time.Second,
+			Destination: &readTimeout,
+		},
+		cli.BoolFlag{
+			Name:        "robots-disallow-all",
+			Usage:       "forbid crawling the whole site in robots.txt, e.g. outside of production",
+			EnvVar:      "ROBOTS_DISALLOW_ALL",
+			Destination: &robotsDisallow,
+		},
+		cli.StringFlag{
+			Name:        "robots-rules",
+			Usage:       "path to a JSON file with the robots.txt rules, e.g. [{\"user_agents\": [\"*\"], \"disallow\": [\"/drafts/\"]}]",
+			EnvVar:      "ROBOTS_RULES",
+			Destination: &robotsRules,
+		},
+		cli.DurationFlag{
+			Name:        "shutdown-delay",
+			Usage:       "time during which /readyz reports draining on shutdown before the server stops accepting connections",
+			EnvVar:      "SHUTDOWN_DELAY",
+			Value:       5 * time.Second,
+			Destination: &shutdownDelay,
+		},
+		cli.StringFlag{
+			Name:        "sitemap-exclude",
+			Usage:       "comma-separated patterns of files left out of the sitemap, e.g. drafts/ or *.pdf",
+			EnvVar:      "SITEMAP_EXCLUDE",
+			Destination: &sitemapExclude,
+		},
+		cli.BoolFlag{
+			Name:        "sitemap-images",
+			Usage:       "list the images of each page in the sitemap",
+			EnvVar:      "SITEMAP_IMAGES",
+			Destination: &sitemapImages,
+		},
+		cli.StringFlag{
+			Name:        "sitemap-include",
+			Usage:       "comma-separated patterns of files listed in the sitemap; all if empty",
+			EnvVar:      "SITEMAP_INCLUDE",
+			Destination: &sitemapInclude,
+		},
+		cli.StringFlag{
+			Name:        "sitemap-rules",
+			Usage:       "path to a JSON file setting the changefreq and priority of pages, e.g. [{\"pattern\": \"index.html\", \"priority\": \"1.0\"}]",
+			EnvVar:      "SITEMAP_RULES",
+			Destination: &sitemapRules,
+		},
+		cli.StringFlag{
+			Name:        "tls-cert",
+			Usage:       "path to the PEM certificate chain; serves HTTPS if set, reloaded when the file changes",
+			EnvVar:      "TLS_CERT",
+			Destination: &tlsCert,
+		},
+		cli.StringFlag{
+			Name:        "tls-key",
+			Usage:       "path to the PEM private key of --tls-cert",
+			EnvVar:      "TLS_KEY",
+			Destination: &tlsKey,
+		},
+		cli.StringFlag{
+			Name:        "tls-redirect-addr",
+			Usage:       "address of a plain HTTP listener redirecting to HTTPS, e.g. :80, with the syntax of --addr; disabled if empty",
+			EnvVar:      "TLS_REDIRECT_ADDR",
+			Destination: &tlsRedirectAddr,
+		},
+		cli.BoolFlag{
+			Name:        "warm",
+			Usage:       "render the warm-up variants of all images into the cache in the background",
+			EnvVar:      "WARM",
+			Destination: &warm,
+		},
+		cli.DurationFlag{
+			Name:        "write-timeout",
+			Usage:       "time allowed to write the response, including rendering the image",
+			EnvVar:      "WRITE_TIMEOUT",
+			Value:       2 * time.Minute,
+			Destination: &writeTimeout,
+		},
+	}, append(imageFlags, warmFlags...)...)
+
 	app.Action = func(_ *cli.Context) error {
+		imageOpts, err := imageOptions()
+		if err != nil {
+			return err
+		}
+
+		var warmOpts pkg.WarmOptions
+
+		if warm {
+			if warmOpts, err = warmOptions(); err != nil {
+				return err
+			}
+		}
+
+		sitemapOpts := handlers.SitemapOptions{
+			BaseURL: baseURL,
+			Exclude: splitList(sitemapExclude),
+			Images:  sitemapImages,
+			Include: splitList(sitemapInclude),
+		}
+
+		if sitemapRules != "" {
+			if sitemapOpts.Rules, err = handlers.ReadSitemapRules(sitemapRules); err != nil {
+				return err
+			}
+		}
+
+		robotsOpts := handlers.RobotsOptions{
+			BaseURL:     baseURL,
+			DisallowAll: robotsDisallow,
+		}
+
+		if robotsRules != "" {
+			if robotsOpts.Groups, err = handlers.ReadRobotsGroups(robotsRules); err != nil {
+				return err
+			}
+		}
+
+		if (tlsCert == "") != (tlsKey == "") {
+			return errors.New("--tls-cert and --tls-key must be set together")
+		}
+
+		if tlsRedirectAddr != "" && tlsCert == "" {
+			return errors.New("--tls-redirect-addr requires --tls-cert")
+		}
+
+		if protocol, err = pkg.ParseProtocol(protocol, tlsCert != ""); err != nil {
+			return err
+		}
+
+		for _, f := range []struct {
+			name  string
+			value int64
+		}{
+			{name: "drain-timeout", value: int64(drainTimeout)},
+			{name: "health-interval", value: int64(healthInterval)},
+			{name: "health-timeout", value: int64(healthTimeout)},
+			{name: "idle-timeout", value: int64(idleTimeout)},
+			{name: "max-body-bytes", value: maxBodyBytes},
+			{name: "max-header-bytes", value: int64(maxHeaderBytes)},
+			{name: "read-header-timeout", value: int64(readHdrTimeout)},
+			{name: "read-timeout", value: int64(readTimeout)},
+			{name: "shutdown-delay", value: int64(shutdownDelay)},
+			{name: "write-timeout", value: int64(writeTimeout)},
+		} {
+			if f.value < 0 {
+				return fmt.Errorf("--%s cannot be negative", f.name)
+			}
+		}
+
+		metaHeadersPaths := splitList(metaPaths)
+
+		for _, prefix := range metaHeadersPaths {
+			if !strings.HasPrefix(prefix, "/") {
+				return fmt.Errorf("%q: --meta-headers-paths must only contain absolute paths", prefix)
+			}
+		}
+
+		health, err := healthRegistry()
+		if err != nil {
+			return err
+		}
+
+		opts := pkg.ServerOptions{
+			Addr:      addr,
+			DebugAddr: debugAddr,
+			Dir:       dir,
+			Health:    health,
+			HTTP: pkg.HTTPOptions{
+				IdleTimeout:       idleTimeout,
+				MaxBodyBytes:      maxBodyBytes,
+				MaxHeaderBytes:    maxHeaderBytes,
+				ReadHeaderTimeout: readHdrTimeout,
+				ReadTimeout:       readTimeout,
+				WriteTimeout:      writeTimeout,
+			},
+			Image:            imageOpts,
+			MetaHeadersPaths: metaHeadersPaths,
+			Protocol:         protocol,
+			Robots:           robotsOpts,
+			Shutdown: pkg.ShutdownOptions{
+				Delay:        shutdownDelay,
+				DrainTimeout: drainTimeout,
+			},
+			Sitemap: sitemapOpts,
+			TLS: pkg.TLSOptions{
+				CertFile:     tlsCert,
+				KeyFile:      tlsKey,
+				RedirectAddr: tlsRedirectAddr,
+			},
+			Warm: warmOpts,
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+		go func() {
+			sig := <-signals
+			log.Printf("Received %v", sig)
+
+			// A second signal kills the process right away
+			signal.Stop(signals)
+			cancel()
+		}()
+
 		log.Print("Serving contents from " + dir)
 		log.Print("Starting the server on " + addr)
 
-		return pkg.StartServer(addr, dir, quality)
+		return pkg.StartServer(ctx, opts)
+	}
+
+	app.Commands = []cli.Command{
+		{
+			Name:  "warm",
+			Usage: "render variants of all images into the cache, then exit",
+			Flags: append(imageFlags, warmFlags...),
+			Action: func(_ *cli.Context) error {
+				imageOpts, err := imageOptions()
+				if err != nil {
+					return err
+				}
+
+				warmOpts, err := warmOptions()
+				if err != nil {
+					return err
+				}
+
+				return pkg.Warm(dir, imageOpts, warmOpts)
+			},
+		},
+		{
+			Name:  "export",
+			Usage: "render variants of all images to a directory, with a JSON manifest",
+			Flags: append([]cli.Flag{
+				cli.StringFlag{
+					Name:        "formats",
+					Usage:       "comma-separated output formats, among jpg, jxr and webp",
+					EnvVar:      "EXPORT_FORMATS",
+					Value:       "jpg,webp",
+					Destination: &exportFormats,
+				},
+				cli.StringFlag{
+					Name:        "out",
+					Usage:       "path to the output directory",
+					EnvVar:      "OUT",
+					Value:       "export",
+					Destination: &outDir,
+				},
+				cli.StringFlag{
+					Name:        "sizes",
+					Usage:       "comma-separated sizes rendered in every format: original, or a width or height such as 1920w or 1080h",
+					EnvVar:      "EXPORT_SIZES",
+					Value:       "original",
+					Destination: &exportSizes,
+				},
+			}, imageFlags...),
+			Action: func(_ *cli.Context) error {
+				imageOpts, err := imageOptions()
+				if err != nil {
+					return err
+				}
+
+				variants, err := handlers.ParseVariants(splitList(exportFormats), splitList(exportSizes), nil)
+				if err != nil {
+					return err
+				}
+
+				return pkg.Export(dir, outDir, imageOpts, variants)
+			},
+		},
 	}
 
 	if err := app.Run(os.Args); err != nil {
 		log.Fatal(err)
 	}
 }
+
+// splitList splits a comma-separated list, ignoring empty items.
+func splitList(s string) []string {
+	var items []string
+
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
@@ -0,0 +1,266 @@
+package pkg
+
+import (
+	"compress/gzip"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+const (
+	encodingBrotli = "br"
+	encodingGzip   = "gzip"
+)
+
+// supportedEncodings are the encodings replies are compressed with, in order
+// of preference.
+var supportedEncodings = []string{encodingBrotli, encodingGzip}
+
+// compressibleTypes are the compressible media types besides text/*. Other
+// image formats are compressed already.
+var compressibleTypes = map[string]bool{
+	"application/javascript": true,
+	"application/json":       true,
+	"application/xml":        true,
+	"image/svg+xml":          true,
+}
+
+var gzipWriters = sync.Pool{
+	New: func() interface{} {
+		return gzip.NewWriter(nil)
+	},
+}
+
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	return strings.HasPrefix(mediaType, "text/") || compressibleTypes[mediaType]
+}
+
+// acceptedEncodings returns the encodings among br and gzip accepted by a
+// request with the given Accept-Encoding header, in order of preference.
+func acceptedEncodings(header string) []string {
+	q := make(map[string]float64)
+
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+
+		if coding == "" {
+			continue
+		}
+
+		weight := 1.0
+
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+
+			if strings.HasPrefix(param, "q=") {
+				if w, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64); err == nil {
+					weight = w
+				}
+			}
+		}
+
+		q[coding] = weight
+	}
+
+	var accepted []string
+
+	for _, encoding := range supportedEncodings {
+		weight, ok := q[encoding]
+		if !ok {
+			weight, ok = q["*"]
+		}
+
+		if ok && weight > 0 {
+			accepted = append(accepted, encoding)
+		}
+	}
+
+	// Prefer the highest weight; br wins ties
+	if len(accepted) == 2 && q[accepted[1]] > q[accepted[0]] {
+		accepted[0], accepted[1] = accepted[1], accepted[0]
+	}
+
+	return accepted
+}
+
+// encodedETag returns the entity tag of the body tagged etag once compressed
+// with encoding, e.g. "abc-gzip". Compressed bodies differ from the plain ones,
+// so they cannot share a strong validator.
+func encodedETag(etag, encoding string) string {
+	if !strings.HasSuffix(etag, `"`) {
+		return etag
+	}
+
+	return strings.TrimSuffix(etag, `"`) + "-" + encoding + `"`
+}
+
+// decodedETags returns the If-None-Match header ifNoneMatch with the entity
+// tags of bodies compressed with encoding replaced with those of the plain
+// bodies, which handlers know about. It returns false if there were none.
+func decodedETags(ifNoneMatch, encoding string) (string, bool) {
+	var (
+		suffix  = "-" + encoding + `"`
+		tags    = strings.Split(ifNoneMatch, ",")
+		decoded = false
+	)
+
+	for i, tag := range tags {
+		tag = strings.TrimSpace(tag)
+
+		if strings.HasSuffix(tag, suffix) {
+			tag = strings.TrimSuffix(tag, suffix) + `"`
+			decoded = true
+		}
+
+		tags[i] = tag
+	}
+
+	return strings.Join(tags, ", "), decoded
+}
+
+// compressWriter compresses the response once its headers show that it is
+// worth it.
+type compressWriter struct {
+	http.ResponseWriter
+
+	// encoding is the preferred encoding of the client; nothing is
+	// compressed if empty.
+	encoding string
+
+	// conditional is true if the request was made conditional on the entity
+	// tag of a body compressed with encoding.
+	conditional bool
+
+	w           io.WriteCloser
+	wroteHeader bool
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+
+	cw.wroteHeader = true
+
+	h := cw.Header()
+
+	// Not modified replies have no Content-Type; they validate the body the
+	// client has, compressed if it asked with the compressed body's tag.
+	if status == http.StatusNotModified && cw.conditional && h.Get("Content-Encoding") == "" {
+		if etag := h.Get("ETag"); etag != "" {
+			h.Set("ETag", encodedETag(etag, cw.encoding))
+		}
+	}
+
+	if h.Get("Content-Encoding") != "" || !compressible(h.Get("Content-Type")) {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	h.Add("Vary", "Accept-Encoding")
+
+	switch {
+	case cw.encoding == "":
+	case status < http.StatusOK, status == http.StatusNoContent, status == http.StatusPartialContent, status == http.StatusNotModified:
+	default:
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", cw.encoding)
+
+		if etag := h.Get("ETag"); etag != "" {
+			h.Set("ETag", encodedETag(etag, cw.encoding))
+		}
+
+		if cw.encoding == encodingBrotli {
+			cw.w = brotli.NewWriter(cw.ResponseWriter)
+		} else {
+			gw := gzipWriters.Get().(*gzip.Writer)
+			gw.Reset(cw.ResponseWriter)
+			cw.w = gw
+		}
+	}
+
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		// Sniff the type before it is too late to compress
+		if cw.Header().Get("Content-Type") == "" {
+			cw.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	if cw.w != nil {
+		return cw.w.Write(b)
+	}
+
+	return cw.ResponseWriter.Write(b)
+}
+
+// Flush sends the data compressed so far to the client.
+func (cw *compressWriter) Flush() {
+	if f, ok := cw.w.(interface{ Flush() error }); ok {
+		if err := f.Flush(); err != nil {
+			log.Printf("Could not flush the compressed reply: %v", err)
+		}
+	}
+
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (cw *compressWriter) close() {
+	if cw.w == nil {
+		return
+	}
+
+	if err := cw.w.Close(); err != nil {
+		log.Printf("Could not finish the compressed reply: %v", err)
+	}
+
+	if gw, ok := cw.w.(*gzip.Writer); ok {
+		gzipWriters.Put(gw)
+	}
+}
+
+// Compress compresses text, JSON, XML and SVG replies with brotli or gzip, as
+// negotiated with Accept-Encoding.
+func Compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cw := &compressWriter{ResponseWriter: w}
+
+		if encodings := acceptedEncodings(r.Header.Get("Accept-Encoding")); len(encodings) != 0 && r.Method != http.MethodHead {
+			cw.encoding = encodings[0]
+
+			if inm := r.Header.Get("If-None-Match"); inm != "" {
+				if decoded, ok := decodedETags(inm, cw.encoding); ok {
+					// Do not alter the headers of the caller's request
+					r = r.WithContext(r.Context())
+					r.Header = r.Header.Clone()
+					r.Header.Set("If-None-Match", decoded)
+
+					cw.conditional = true
+				}
+			}
+		}
+
+		defer cw.close()
+
+		next.ServeHTTP(cw, r)
+	})
+}
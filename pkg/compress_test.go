@@ -0,0 +1,186 @@
+package pkg
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func Test_acceptedEncodings(t *testing.T) {
+	cases := map[string]string{
+		"":                        "[]",
+		"identity":                "[]",
+		"gzip, deflate":           "[gzip]",
+		"gzip, deflate, br":       "[br gzip]",
+		"br;q=0.5, gzip":          "[gzip br]",
+		"br;q=0, gzip;q=0.1":      "[gzip]",
+		"*":                       "[br gzip]",
+		"GZIP;q=1.0, *;q=0":       "[gzip]",
+		" br ; q=1 , gzip ; q=1 ": "[br gzip]",
+	}
+
+	for header, expected := range cases {
+		if got := fmt.Sprint(acceptedEncodings(header)); got != expected {
+			t.Fatalf("%q: expected %s, got %s", header, expected, got)
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	body := strings.Repeat(`{"key": "value"}`, 100)
+
+	h := Compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/image.jpg":
+			w.Header().Set("Content-Type", "image/jpeg")
+		case "/not-modified":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+		}
+
+		fmt.Fprint(w, body)
+	}))
+
+	get := func(t *testing.T, url, acceptEncoding string) (*http.Response, []byte) {
+		r := httptest.NewRequest(http.MethodGet, url, nil)
+
+		if acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, r)
+
+		res := w.Result()
+
+		b, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return res, b
+	}
+
+	t.Run("gzip", func(t *testing.T) {
+		res, b := get(t, "/data", "gzip")
+
+		if res.Header.Get("Content-Encoding") != "gzip" || res.Header.Get("Vary") != "Accept-Encoding" || res.Header.Get("Content-Length") != "" {
+			t.Fatalf("Unexpected headers %v", res.Header)
+		}
+
+		zr, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if plain, err := ioutil.ReadAll(zr); err != nil || string(plain) != body {
+			t.Fatalf("Unexpected body %q, %v", plain, err)
+		}
+	})
+
+	t.Run("brotli", func(t *testing.T) {
+		res, b := get(t, "/data", "gzip, br")
+
+		if res.Header.Get("Content-Encoding") != "br" {
+			t.Fatalf("Unexpected headers %v", res.Header)
+		}
+
+		if plain, err := ioutil.ReadAll(brotli.NewReader(bytes.NewReader(b))); err != nil || string(plain) != body {
+			t.Fatalf("Unexpected body %q, %v", plain, err)
+		}
+	})
+
+	t.Run("not accepted", func(t *testing.T) {
+		res, b := get(t, "/data", "")
+
+		if res.Header.Get("Content-Encoding") != "" || res.Header.Get("Vary") != "Accept-Encoding" || string(b) != body {
+			t.Fatalf("Unexpected reply %v: %q", res.Header, b)
+		}
+	})
+
+	t.Run("images are left alone", func(t *testing.T) {
+		res, b := get(t, "/image.jpg", "gzip, br")
+
+		if res.Header.Get("Content-Encoding") != "" || res.Header.Get("Vary") != "" || string(b) != body {
+			t.Fatalf("Unexpected reply %v: %q", res.Header, b)
+		}
+	})
+
+	t.Run("no body", func(t *testing.T) {
+		res, b := get(t, "/not-modified", "gzip")
+
+		if res.StatusCode != http.StatusNotModified || res.Header.Get("Content-Encoding") != "" || len(b) != 0 {
+			t.Fatalf("Unexpected reply HTTP %d %v: %q", res.StatusCode, res.Header, b)
+		}
+	})
+}
+
+func TestCompress_etag(t *testing.T) {
+	h := Compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"abc"`)
+
+		if r.Header.Get("If-None-Match") == `"abc"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"key": "value"}`)
+	}))
+
+	cases := []struct {
+		name           string
+		acceptEncoding string
+		ifNoneMatch    string
+		status         int
+		etag           string
+	}{
+		{name: "plain", status: http.StatusOK, etag: `"abc"`},
+		{name: "gzip", acceptEncoding: "gzip", status: http.StatusOK, etag: `"abc-gzip"`},
+		{name: "brotli", acceptEncoding: "br", status: http.StatusOK, etag: `"abc-br"`},
+		{name: "plain not modified", ifNoneMatch: `"abc"`, status: http.StatusNotModified, etag: `"abc"`},
+		{name: "gzip not modified", acceptEncoding: "gzip", ifNoneMatch: `"abc-gzip"`, status: http.StatusNotModified, etag: `"abc-gzip"`},
+		// The client has the plain body, but now accepts gzip
+		{name: "gzip modified", acceptEncoding: "gzip", ifNoneMatch: `"abc-br"`, status: http.StatusOK, etag: `"abc-gzip"`},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+			if c.acceptEncoding != "" {
+				r.Header.Set("Accept-Encoding", c.acceptEncoding)
+			}
+
+			if c.ifNoneMatch != "" {
+				r.Header.Set("If-None-Match", c.ifNoneMatch)
+			}
+
+			w := httptest.NewRecorder()
+
+			h.ServeHTTP(w, r)
+
+			res := w.Result()
+
+			if res.StatusCode != c.status || res.Header.Get("ETag") != c.etag {
+				t.Fatalf("Expected HTTP %d with ETag %s, got HTTP %d with ETag %s", c.status, c.etag, res.StatusCode, res.Header.Get("ETag"))
+			}
+
+			if c.ifNoneMatch != "" && r.Header.Get("If-None-Match") != c.ifNoneMatch {
+				t.Fatalf("The request was altered: %q", r.Header.Get("If-None-Match"))
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/gographics/imagick.v2/imagick"
+
+	"git.quba.fr/qbarrand/quba.fr-server/pkg/handlers"
+)
+
+// manifestName is the name of the manifest written in the output directory.
+const manifestName = "manifest.json"
+
+// Export renders variants of every image in dir to outDir, along with a JSON
+// manifest describing the written files.
+func Export(dir, outDir string, imageOpts handlers.ImageOptions, variants []handlers.Variant) error {
+	imagick.Initialize()
+	defer imagick.Terminate()
+
+	manifest, failed, err := handlers.NewImage(dir, imageOpts).Export(context.Background(), outDir, variants)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not encode the manifest: %v", err)
+	}
+
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return err
+	}
+
+	manifestPath := filepath.Join(outDir, manifestName)
+
+	if err := ioutil.WriteFile(manifestPath, append(b, '\n'), 0644); err != nil {
+		return fmt.Errorf("could not write the manifest: %v", err)
+	}
+
+	log.Printf("Exported %d images; wrote %s", len(manifest.Images), manifestPath)
+
+	if failed != 0 {
+		return fmt.Errorf("%d variants could not be exported", failed)
+	}
+
+	return nil
+}
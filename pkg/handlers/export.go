@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// ExportedVariant describes a file written by Image.Export.
+type ExportedVariant struct {
+	// Path is relative to the output directory, with forward slashes.
+	Path   string `json:"path"`
+	Format string `json:"format"`
+	Width  uint   `json:"width"`
+	Height uint   `json:"height"`
+	Bytes  int64  `json:"bytes"`
+	Hash   string `json:"hash"`
+}
+
+// ExportedImage describes a source image and its exported variants.
+type ExportedImage struct {
+	Width     uint              `json:"width"`
+	Height    uint              `json:"height"`
+	MainColor string            `json:"mainColor"`
+	Variants  []ExportedVariant `json:"variants"`
+}
+
+// ExportManifest maps the path of each source image, relative to the base
+// directory with forward slashes, to its variants.
+type ExportManifest struct {
+	Images map[string]*ExportedImage `json:"images"`
+}
+
+// exportPath returns the path of v of the source image rel, relative to the
+// output directory, e.g. album/photo.jpg-1920w.webp. The source extension is
+// kept so that sources sharing a stem, e.g. a.jpg and a.png, do not overwrite
+// each other's variants.
+func exportPath(rel string, v Variant) string {
+	base := rel
+
+	switch {
+	case v.Width != 0:
+		base += fmt.Sprintf("-%dw", v.Width)
+	case v.Height != 0:
+		base += fmt.Sprintf("-%dh", v.Height)
+	}
+
+	return base + "." + v.Format
+}
+
+// exportVariant renders v of the image at path to outDir. If source is not
+// nil, it is filled with the properties of the source image.
+func (i Image) exportVariant(ctx context.Context, path, rel, outDir string, v Variant, source *ExportedImage) (ExportedVariant, error) {
+	p, err := i.imageControllerCtor(ctx, path)
+	if err != nil {
+		return ExportedVariant{}, fmt.Errorf("could not create the image controller: %v", err)
+	}
+	defer p.Destroy()
+
+	if source != nil {
+		source.Height, source.Width = p.Dimensions()
+
+		cr, cg, cb, err := p.MainColor()
+		if err != nil {
+			return ExportedVariant{}, fmt.Errorf("could not get the main color: %v", err)
+		}
+
+		source.MainColor = fmt.Sprintf("#%02X%02X%02X", cr, cg, cb)
+	}
+
+	if err := i.render(p, v); err != nil {
+		return ExportedVariant{}, err
+	}
+
+	ev := ExportedVariant{
+		Path:   filepath.ToSlash(exportPath(rel, v)),
+		Format: v.Format,
+	}
+
+	ev.Height, ev.Width = p.Dimensions()
+
+	outPath := filepath.Join(outDir, exportPath(rel, v))
+
+	if err := os.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
+		return ExportedVariant{}, err
+	}
+
+	f, err := os.Create(outPath)
+	if err != nil {
+		return ExportedVariant{}, err
+	}
+
+	h := fnv.New64a()
+
+	n, err := p.WriteTo(io.MultiWriter(f, h))
+
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+
+	if err != nil {
+		os.Remove(outPath)
+		return ExportedVariant{}, fmt.Errorf("could not write %s: %v", outPath, err)
+	}
+
+	ev.Bytes = n
+	ev.Hash = hex.EncodeToString(h.Sum(nil))
+
+	return ev, nil
+}
+
+// Export renders variants of every image below the base directory to outDir,
+// mirroring the directory structure, and returns the manifest of the written
+// files. Variants that cannot be exported are logged and left out of the
+// manifest; Export returns how many variants failed.
+func (i Image) Export(ctx context.Context, outDir string, variants []Variant) (ExportManifest, int, error) {
+	manifest := ExportManifest{Images: make(map[string]*ExportedImage)}
+
+	paths, _, _, err := scanImages(i.baseDir)
+	if err != nil {
+		return manifest, 0, fmt.Errorf("could not list the images in %s: %v", i.baseDir, err)
+	}
+
+	absOut, err := filepath.Abs(outDir)
+	if err != nil {
+		return manifest, 0, err
+	}
+
+	failed := 0
+
+	for _, path := range paths {
+		// Do not export our own output if it is below the base directory
+		if absPath, err := filepath.Abs(path); err == nil && isBelow(absOut, absPath) {
+			continue
+		}
+
+		rel, err := filepath.Rel(i.baseDir, path)
+		if err != nil {
+			return manifest, failed, err
+		}
+
+		var exported *ExportedImage
+
+		for _, v := range variants {
+			if err := ctx.Err(); err != nil {
+				return manifest, failed, err
+			}
+
+			// The first variant also reads the properties of the source
+			var src *ExportedImage
+
+			if exported == nil {
+				src = &ExportedImage{}
+			}
+
+			ev, err := i.exportVariant(ctx, path, rel, outDir, v, src)
+			if err != nil {
+				log.Printf("Could not export %s as %s: %v", path, v, err)
+				failed++
+				continue
+			}
+
+			if exported == nil {
+				exported = src
+				manifest.Images[filepath.ToSlash(rel)] = exported
+			}
+
+			exported.Variants = append(exported.Variants, ev)
+
+			log.Printf("Exported %s as %s (%d bytes)", path, ev.Path, ev.Bytes)
+		}
+	}
+
+	return manifest, failed, nil
+}
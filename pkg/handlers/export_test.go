@@ -0,0 +1,233 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+
+	"git.quba.fr/qbarrand/quba.fr-server/pkg/handlers/mock_handlers"
+	img "git.quba.fr/qbarrand/quba.fr-server/pkg/image"
+)
+
+func Test_exportPath(t *testing.T) {
+	cases := map[string]Variant{
+		"a.jpg.jpg":                  {Format: "jpg"},
+		"a.jpg.webp":                 {Format: "webp"},
+		"a.jpg-1920w.webp":           {Format: "webp", Width: 1920},
+		"a.jpg-1080h.jxr":            {Format: "jxr", Height: 1080},
+		"album/photo.JPEG-640w.webp": {Format: "webp", Width: 640},
+	}
+
+	for expected, v := range cases {
+		rel := "a.jpg"
+
+		if filepath.Dir(expected) == "album" {
+			rel = "album/photo.JPEG"
+		}
+
+		if got := exportPath(rel, v); got != expected {
+			t.Fatalf("%s as %s: expected %q, got %q", rel, v, expected, got)
+		}
+	}
+}
+
+func TestImage_Export(t *testing.T) {
+	dir, err := ioutil.TempDir("", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	outDir := filepath.Join(dir, "out")
+
+	if err := os.MkdirAll(filepath.Join(dir, "album"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"album/a.jpg", "out/old.jpg"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	controller := gomock.NewController(t)
+	decoded := 0
+
+	i := NewImage(dir, ImageOptions{Quality: 80})
+	i.imageControllerCtor = func(_ context.Context, path string) (imageController, error) {
+		if filepath.Base(path) != "a.jpg" {
+			t.Fatalf("Unexpected image %s", path)
+		}
+
+		mockIC := mock_handlers.NewMockimageController(controller)
+
+		// The first variant also reads the properties of the source image
+		if decoded == 0 {
+			gomock.InOrder(
+				mockIC.EXPECT().Dimensions().Return(uint(3000), uint(4000)),
+				mockIC.EXPECT().MainColor().Return(uint(1), uint(2), uint(3), nil),
+				mockIC.EXPECT().Resize(uint(0), uint(640)),
+				mockIC.EXPECT().Dimensions().Return(uint(480), uint(640)),
+			)
+		} else {
+			mockIC.EXPECT().Dimensions().Return(uint(3000), uint(4000))
+		}
+
+		mockIC.EXPECT().StripMetadata(img.StripAll)
+		mockIC.EXPECT().SetQuality(uint(80))
+		mockIC.EXPECT().Convert(gomock.Any())
+		mockIC.EXPECT().WriteTo(gomock.Any()).DoAndReturn(func(w io.Writer) (int64, error) {
+			n, err := io.WriteString(w, "image")
+			return int64(n), err
+		})
+		mockIC.EXPECT().Destroy()
+
+		decoded++
+
+		return mockIC, nil
+	}
+
+	variants := []Variant{
+		{Format: "webp", Width: 640},
+		{Format: "jpg"},
+	}
+
+	manifest, failed, err := i.Export(context.Background(), outDir, variants)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if failed != 0 {
+		t.Fatalf("Expected no failures, got %d", failed)
+	}
+
+	if len(manifest.Images) != 1 {
+		t.Fatalf("Only album/a.jpg should be exported, got %v", manifest.Images)
+	}
+
+	exported := manifest.Images["album/a.jpg"]
+	if exported == nil {
+		t.Fatalf("album/a.jpg is missing from %v", manifest.Images)
+	}
+
+	if exported.Width != 4000 || exported.Height != 3000 || exported.MainColor != "#010203" {
+		t.Fatalf("Unexpected source properties %+v", exported)
+	}
+
+	expected := []ExportedVariant{
+		{Path: "album/a.jpg-640w.webp", Format: "webp", Width: 640, Height: 480, Bytes: 5},
+		{Path: "album/a.jpg.jpg", Format: "jpg", Width: 4000, Height: 3000, Bytes: 5},
+	}
+
+	hash, err := hashBytes([]byte("image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(exported.Variants) != len(expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, exported.Variants)
+	}
+
+	for n, ev := range exported.Variants {
+		expected[n].Hash = hash
+
+		if ev != expected[n] {
+			t.Fatalf("Expected %+v, got %+v", expected[n], ev)
+		}
+
+		b, err := ioutil.ReadFile(filepath.Join(outDir, filepath.FromSlash(ev.Path)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(b) != "image" {
+			t.Fatalf("Unexpected contents %q", b)
+		}
+	}
+}
+
+func TestImage_Export_sharedStem(t *testing.T) {
+	dir, err := ioutil.TempDir("", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	outDir := filepath.Join(dir, "out")
+
+	// Same stems, and a source named like the variant of another
+	sources := []string{"a.jpg", "a.jpeg", "a.png", "x.jpg", "x-640w.jpg"}
+
+	for _, name := range sources {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	controller := gomock.NewController(t)
+
+	i := NewImage(dir, ImageOptions{Quality: 80})
+	i.imageControllerCtor = func(_ context.Context, path string) (imageController, error) {
+		mockIC := mock_handlers.NewMockimageController(controller)
+
+		mockIC.EXPECT().Dimensions().Return(uint(480), uint(640)).AnyTimes()
+		mockIC.EXPECT().MainColor().Return(uint(1), uint(2), uint(3), nil)
+		mockIC.EXPECT().Resize(uint(0), uint(640))
+		mockIC.EXPECT().StripMetadata(img.StripAll)
+		mockIC.EXPECT().SetQuality(uint(80))
+		mockIC.EXPECT().Convert("jpg")
+		mockIC.EXPECT().WriteTo(gomock.Any()).DoAndReturn(func(w io.Writer) (int64, error) {
+			// Write the name of the source, to check that nothing is
+			// overwritten
+			n, err := io.WriteString(w, filepath.Base(path))
+			return int64(n), err
+		})
+		mockIC.EXPECT().Destroy()
+
+		return mockIC, nil
+	}
+
+	manifest, failed, err := i.Export(context.Background(), outDir, []Variant{{Format: "jpg", Width: 640}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if failed != 0 {
+		t.Fatalf("Expected no failures, got %d", failed)
+	}
+
+	paths := make(map[string]bool)
+
+	for _, name := range sources {
+		exported := manifest.Images[name]
+		if exported == nil || len(exported.Variants) != 1 {
+			t.Fatalf("%s: unexpected manifest entry %+v", name, exported)
+		}
+
+		p := exported.Variants[0].Path
+
+		if paths[p] {
+			t.Fatalf("%s: %s is shared with another source", name, p)
+		}
+
+		paths[p] = true
+
+		b, err := ioutil.ReadFile(filepath.Join(outDir, filepath.FromSlash(p)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(b) != name {
+			t.Fatalf("%s: %s holds the variant of %s", name, p, b)
+		}
+	}
+}
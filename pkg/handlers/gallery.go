@@ -0,0 +1,383 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	img "git.quba.fr/qbarrand/quba.fr-server/pkg/image"
+)
+
+const (
+	defaultPerPage = 50
+	maxPerPage     = 500
+
+	// galleryRescanInterval is the minimum time between two walks of a
+	// directory for changes.
+	galleryRescanInterval = 10 * time.Second
+)
+
+// imageExtensions are the extensions of the files listed in galleries and
+// warmed up.
+var imageExtensions = map[string]bool{
+	".gif":  true,
+	".jpeg": true,
+	".jpg":  true,
+	".png":  true,
+	".tif":  true,
+	".tiff": true,
+	".webp": true,
+}
+
+type (
+	galleryImage struct {
+		Path      string `json:"path"`
+		Width     uint   `json:"width"`
+		Height    uint   `json:"height"`
+		Date      string `json:"date"`
+		Location  string `json:"location"`
+		MainColor string `json:"mainColor"`
+	}
+
+	galleryPage struct {
+		Images  []galleryImage `json:"images"`
+		Page    int            `json:"page"`
+		PerPage int            `json:"perPage"`
+		Total   int            `json:"total"`
+	}
+
+	// galleryEntry is the cached metadata of a single file. It is valid as long
+	// as the file keeps the same size and modification time.
+	galleryEntry struct {
+		image   galleryImage
+		modTime time.Time
+		size    int64
+	}
+
+	// galleryListing is the cached, sorted listing of a directory. It is valid
+	// as long as the fingerprint of the directory does not change.
+	galleryListing struct {
+		fingerprint uint64
+		images      []galleryImage
+		scanned     time.Time
+	}
+
+	gallery struct {
+		baseDir             string
+		imageControllerCtor func(context.Context, string) (imageController, error)
+		rescanInterval      time.Duration
+
+		// dirLocks serializes the listings of each directory, so that
+		// refreshing a large album does not block the others.
+		dirLocks map[string]*sync.Mutex
+
+		// m guards dirLocks, entries and listings.
+		entries  map[string]galleryEntry
+		listings map[string]galleryListing
+		m        sync.Mutex
+	}
+)
+
+// Gallery returns a handler listing the images below a directory of baseDir
+// as JSON, newest first.
+func Gallery(baseDir string) http.Handler {
+	imageProcessorCtor := func(ctx context.Context, path string) (imageController, error) {
+		// Listings only need the dimensions and properties
+		p, err := img.PingImagickProcessor(ctx, path)
+		if err != nil {
+			return nil, err
+		}
+
+		return imageController(p), nil
+	}
+
+	return &gallery{
+		baseDir:             baseDir,
+		imageControllerCtor: imageProcessorCtor,
+		rescanInterval:      galleryRescanInterval,
+		dirLocks:            make(map[string]*sync.Mutex),
+		entries:             make(map[string]galleryEntry),
+		listings:            make(map[string]galleryListing),
+	}
+}
+
+func parsePagination(r *http.Request) (int, int, error) {
+	page := 1
+	perPage := defaultPerPage
+
+	if pageStr := r.FormValue("page"); pageStr != "" {
+		p, err := strconv.Atoi(pageStr)
+		if err != nil || p < 1 {
+			return 0, 0, fmt.Errorf("%q: invalid page", pageStr)
+		}
+
+		page = p
+	}
+
+	if perPageStr := r.FormValue("per_page"); perPageStr != "" {
+		pp, err := strconv.Atoi(perPageStr)
+		if err != nil || pp < 1 || pp > maxPerPage {
+			return 0, 0, fmt.Errorf("%q: invalid number of images per page", perPageStr)
+		}
+
+		perPage = pp
+	}
+
+	return page, perPage, nil
+}
+
+// isBelow returns true if path is inside dir.
+func isBelow(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// scanImages walks dir and returns the image files it contains, along with a
+// fingerprint that changes whenever one of them is added, removed or modified.
+func scanImages(dir string) ([]string, map[string]os.FileInfo, uint64, error) {
+	var paths []string
+
+	infos := make(map[string]os.FileInfo)
+	h := fnv.New64a()
+
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if fi.IsDir() {
+			// Skip hidden directories such as .git
+			if path != dir && strings.HasPrefix(fi.Name(), ".") {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if !imageExtensions[strings.ToLower(filepath.Ext(path))] {
+			return nil
+		}
+
+		paths = append(paths, path)
+		infos[path] = fi
+
+		fmt.Fprintf(h, "%s\x00%d\x00%d\x00", path, fi.Size(), fi.ModTime().UnixNano())
+
+		return nil
+	})
+
+	return paths, infos, h.Sum64(), err
+}
+
+// describe returns the metadata of the image at path, from the cache if the
+// file did not change.
+func (g *gallery) describe(ctx context.Context, path string, fi os.FileInfo) (galleryImage, error) {
+	g.m.Lock()
+	e, ok := g.entries[path]
+	g.m.Unlock()
+
+	if ok && e.size == fi.Size() && e.modTime.Equal(fi.ModTime()) {
+		return e.image, nil
+	}
+
+	p, err := g.imageControllerCtor(ctx, path)
+	if err != nil {
+		return galleryImage{}, fmt.Errorf("could not create the image controller: %v", err)
+	}
+	defer p.Destroy()
+
+	rel, err := filepath.Rel(g.baseDir, path)
+	if err != nil {
+		return galleryImage{}, err
+	}
+
+	height, width := p.Dimensions()
+
+	gi := galleryImage{
+		Path:     "/" + filepath.ToSlash(rel),
+		Width:    width,
+		Height:   height,
+		Date:     p.ExifField("comment"),
+		Location: p.ExifField("Iptc4xmpCore:Location"),
+	}
+
+	if cr, cg, cb, err := p.MainColor(); err != nil {
+		log.Printf("Could not get the main color of %s: %v", path, err)
+	} else {
+		gi.MainColor = fmt.Sprintf("#%02X%02X%02X", cr, cg, cb)
+	}
+
+	g.m.Lock()
+
+	g.entries[path] = galleryEntry{
+		image:   gi,
+		modTime: fi.ModTime(),
+		size:    fi.Size(),
+	}
+
+	g.m.Unlock()
+
+	return gi, nil
+}
+
+// dirLock returns the lock of the listing of dir.
+func (g *gallery) dirLock(dir string) *sync.Mutex {
+	g.m.Lock()
+	defer g.m.Unlock()
+
+	l, ok := g.dirLocks[dir]
+	if !ok {
+		l = &sync.Mutex{}
+		g.dirLocks[dir] = l
+	}
+
+	return l
+}
+
+// list returns the images below dir, newest first. dir is walked for changes
+// at most every rescanInterval. If ctx is done while images are being
+// described, it returns the context error and the listing is not cached.
+func (g *gallery) list(ctx context.Context, dir string) ([]galleryImage, error) {
+	l := g.dirLock(dir)
+	l.Lock()
+	defer l.Unlock()
+
+	g.m.Lock()
+	cached, ok := g.listings[dir]
+	g.m.Unlock()
+
+	if ok && time.Since(cached.scanned) < g.rescanInterval {
+		return cached.images, nil
+	}
+
+	paths, infos, fingerprint, err := scanImages(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if ok && cached.fingerprint == fingerprint {
+		cached.scanned = time.Now()
+
+		g.m.Lock()
+		g.listings[dir] = cached
+		g.m.Unlock()
+
+		return cached.images, nil
+	}
+
+	log.Printf("%s changed; refreshing the gallery", dir)
+
+	images := make([]galleryImage, 0, len(paths))
+
+	for _, path := range paths {
+		gi, err := g.describe(ctx, path, infos[path])
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+
+			log.Printf("Skipping %s: %v", path, err)
+			continue
+		}
+
+		images = append(images, gi)
+	}
+
+	g.m.Lock()
+
+	// Forget the files that were removed
+	for path := range g.entries {
+		if _, ok := infos[path]; !ok && isBelow(dir, path) {
+			delete(g.entries, path)
+		}
+	}
+
+	g.m.Unlock()
+
+	// Newest first; images without a date go last
+	sort.SliceStable(images, func(i, j int) bool {
+		a, b := images[i], images[j]
+
+		if a.Date != b.Date {
+			if a.Date == "" || b.Date == "" {
+				return b.Date == ""
+			}
+
+			return a.Date > b.Date
+		}
+
+		return a.Path < b.Path
+	})
+
+	g.m.Lock()
+	g.listings[dir] = galleryListing{fingerprint: fingerprint, images: images, scanned: time.Now()}
+	g.m.Unlock()
+
+	return images, nil
+}
+
+func (g *gallery) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	page, perPage, err := parsePagination(r)
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// Cleaning an absolute path removes any "..", so that we cannot leave
+	// the base directory.
+	dir := filepath.Join(g.baseDir, filepath.Clean("/"+r.FormValue("dir")))
+
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		log.Printf("%s: not a directory: %v", dir, err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	images, err := g.list(r.Context(), dir)
+	if err != nil {
+		if requestCancelled(r) {
+			return
+		}
+
+		log.Printf("Could not list the images in %s: %v", dir, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	res := galleryPage{
+		Images:  []galleryImage{},
+		Page:    page,
+		PerPage: perPage,
+		Total:   len(images),
+	}
+
+	// Comparing page numbers avoids overflowing (page-1)*perPage
+	if pages := (len(images) + perPage - 1) / perPage; page-1 < pages {
+		start := (page - 1) * perPage
+		end := start + perPage
+
+		if end > len(images) {
+			end = len(images)
+		}
+
+		res.Images = images[start:end]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Printf("could not write the reply: %v", err)
+	}
+}
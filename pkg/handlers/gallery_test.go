@@ -0,0 +1,265 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+
+	"git.quba.fr/qbarrand/quba.fr-server/pkg/handlers/mock_handlers"
+)
+
+func TestGallery(t *testing.T) {
+	if Gallery("") == nil {
+		t.Fatal("Should not return nil")
+	}
+}
+
+func TestGallery_ServeHTTP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gallery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(filepath.Join(dir, "album", ".hidden"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	dates := map[string]string{
+		"a.jpg":               "2019-01-01",
+		"album/b.jpg":         "2020-01-01",
+		"album/c.png":         "",
+		"album/.hidden/d.jpg": "2021-01-01",
+		"album/e.txt":         "2022-01-01",
+	}
+
+	for name := range dates {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	newGallery := func(t *testing.T) (*gallery, *int) {
+		controller := gomock.NewController(t)
+		decoded := 0
+
+		g := Gallery(dir).(*gallery)
+		g.rescanInterval = 0
+		g.imageControllerCtor = func(_ context.Context, path string) (imageController, error) {
+			rel, _ := filepath.Rel(dir, path)
+
+			m := mock_handlers.NewMockimageController(controller)
+			m.EXPECT().Dimensions().Return(uint(10), uint(20))
+			m.EXPECT().ExifField("comment").Return(dates[filepath.ToSlash(rel)])
+			m.EXPECT().ExifField("Iptc4xmpCore:Location")
+			m.EXPECT().MainColor()
+			m.EXPECT().Destroy()
+
+			decoded++
+
+			return m, nil
+		}
+
+		return g, &decoded
+	}
+
+	get := func(t *testing.T, g *gallery, url string) galleryPage {
+		w := httptest.NewRecorder()
+
+		g.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+
+		res := w.Result()
+
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("Got HTTP %d", res.StatusCode)
+		}
+
+		var p galleryPage
+
+		if err := json.NewDecoder(res.Body).Decode(&p); err != nil {
+			t.Fatal(err)
+		}
+
+		return p
+	}
+
+	t.Run("sorted by date, newest first", func(t *testing.T) {
+		g, _ := newGallery(t)
+
+		p := get(t, g, "/_gallery")
+
+		expected := []string{"/album/b.jpg", "/a.jpg", "/album/c.png"}
+
+		if p.Total != len(expected) {
+			t.Fatalf("Expected %d images, got %d", len(expected), p.Total)
+		}
+
+		for i, e := range expected {
+			if p.Images[i].Path != e {
+				t.Fatalf("Unexpected image #%d: expected %q, got %q", i, e, p.Images[i].Path)
+			}
+		}
+
+		if p.Images[0].Width != 20 || p.Images[0].Height != 10 {
+			t.Fatalf("Unexpected dimensions %dx%d", p.Images[0].Width, p.Images[0].Height)
+		}
+	})
+
+	t.Run("subdirectory and pagination", func(t *testing.T) {
+		g, _ := newGallery(t)
+
+		p := get(t, g, "/_gallery?dir=album&page=2&per_page=1")
+
+		if p.Total != 2 || len(p.Images) != 1 || p.Images[0].Path != "/album/c.png" {
+			t.Fatalf("Unexpected page %+v", p)
+		}
+	})
+
+	t.Run("page past the end", func(t *testing.T) {
+		g, _ := newGallery(t)
+
+		for _, page := range []string{"3", "9223372036854775807"} {
+			p := get(t, g, "/_gallery?page="+page+"&per_page=2")
+
+			if p.Total != 3 || len(p.Images) != 0 {
+				t.Fatalf("page %s: unexpected page %+v", page, p)
+			}
+		}
+	})
+
+	t.Run("cannot escape the base directory", func(t *testing.T) {
+		g, _ := newGallery(t)
+
+		p := get(t, g, "/_gallery?dir=../../album")
+
+		if p.Total != 2 {
+			t.Fatalf("Expected 2 images, got %d", p.Total)
+		}
+	})
+
+	t.Run("invalid page: HTTP 400", func(t *testing.T) {
+		g, _ := newGallery(t)
+
+		w := httptest.NewRecorder()
+
+		g.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/_gallery?page=0", nil))
+
+		if res := w.Result(); res.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Got HTTP %d", res.StatusCode)
+		}
+	})
+
+	t.Run("not rescanned within the interval", func(t *testing.T) {
+		g, decoded := newGallery(t)
+		g.rescanInterval = time.Hour
+
+		get(t, g, "/_gallery")
+
+		if err := ioutil.WriteFile(filepath.Join(dir, "album", "f.jpg"), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(filepath.Join(dir, "album", "f.jpg"))
+
+		if p := get(t, g, "/_gallery"); p.Total != 3 || *decoded != 3 {
+			t.Fatalf("Expected the cached listing, got %d images after %d decodings", p.Total, *decoded)
+		}
+	})
+
+	t.Run("cached until the directory changes", func(t *testing.T) {
+		g, decoded := newGallery(t)
+
+		get(t, g, "/_gallery")
+		get(t, g, "/_gallery")
+
+		if *decoded != 3 {
+			t.Fatalf("Expected 3 images to be decoded, got %d", *decoded)
+		}
+
+		if err := ioutil.WriteFile(filepath.Join(dir, "album", "f.jpg"), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(filepath.Join(dir, "album", "f.jpg"))
+
+		if p := get(t, g, "/_gallery"); p.Total != 4 {
+			t.Fatalf("Expected 4 images, got %d", p.Total)
+		}
+
+		if *decoded != 4 {
+			t.Fatalf("Expected only the new image to be decoded, got %d decodings", *decoded)
+		}
+	})
+}
+
+func TestGallery_list_concurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gallery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"large/a.jpg", "small/b.jpg"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	controller := gomock.NewController(t)
+
+	var (
+		started = make(chan struct{})
+		release = make(chan struct{})
+	)
+
+	g := Gallery(dir).(*gallery)
+	g.imageControllerCtor = func(_ context.Context, path string) (imageController, error) {
+		// Describing the large album takes a while
+		if filepath.Base(path) == "a.jpg" {
+			close(started)
+			<-release
+		}
+
+		m := mock_handlers.NewMockimageController(controller)
+		m.EXPECT().Dimensions()
+		m.EXPECT().ExifField(gomock.Any()).Times(2)
+		m.EXPECT().MainColor()
+		m.EXPECT().Destroy()
+
+		return m, nil
+	}
+
+	errs := make(chan error, 1)
+
+	go func() {
+		_, err := g.list(context.Background(), filepath.Join(dir, "large"))
+		errs <- err
+	}()
+
+	<-started
+
+	images, err := g.list(context.Background(), filepath.Join(dir, "small"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(images) != 1 {
+		t.Fatalf("Unexpected listing %+v", images)
+	}
+
+	close(release)
+
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,81 +1,381 @@
 package handlers
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"log"
-	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-const secondsBetweenChecks = 120
+const (
+	DefaultHealthInterval = 2 * time.Minute
+	DefaultHealthTimeout  = 5 * time.Second
+)
+
+// HealthCheck is a check of a dependency of the server.
+type HealthCheck struct {
+	Name string
+
+	// Check returns an error if the dependency is unhealthy. It should give
+	// up once ctx is done.
+	Check func(ctx context.Context) error
+
+	// Interval is the time between two runs of the check.
+	Interval time.Duration
+
+	// Timeout bounds a single run of the check.
+	Timeout time.Duration
+}
+
+// HealthCheckTimings overrides the interval and timeout of a check, if not 0.
+type HealthCheckTimings struct {
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+// ReadHealthConfig reads the timings of the health checks from the JSON file
+// at path, e.g. [{"name": "dns", "interval": "1m", "timeout": "2s"}].
+func ReadHealthConfig(path string) (map[string]HealthCheckTimings, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []struct {
+		Name     string `json:"name"`
+		Interval string `json:"interval"`
+		Timeout  string `json:"timeout"`
+	}
+
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %v", path, err)
+	}
+
+	timings := make(map[string]HealthCheckTimings, len(entries))
+
+	for _, e := range entries {
+		var t HealthCheckTimings
+
+		if e.Interval != "" {
+			if t.Interval, err = time.ParseDuration(e.Interval); err != nil || t.Interval <= 0 {
+				return nil, fmt.Errorf("%q: invalid interval %q", e.Name, e.Interval)
+			}
+		}
+
+		if e.Timeout != "" {
+			if t.Timeout, err = time.ParseDuration(e.Timeout); err != nil || t.Timeout <= 0 {
+				return nil, fmt.Errorf("%q: invalid timeout %q", e.Name, e.Timeout)
+			}
+		}
+
+		timings[e.Name] = t
+	}
+
+	return timings, nil
+}
+
+// minHealthBackoff is the delay before re-running a check after its first
+// failure. It doubles with each consecutive failure, up to the interval of
+// the check.
+const minHealthBackoff = time.Second
+
+// errNotChecked is the error of the checks that did not run yet.
+var errNotChecked = errors.New("not checked yet")
+
+// HealthResult is the outcome of the last run of a check.
+type HealthResult struct {
+	Name    string
+	Err     error
+	LastRun time.Time
+	Latency time.Duration
+}
+
+// runHealthCheck runs c once, giving up after its timeout.
+func runHealthCheck(ctx context.Context, c HealthCheck) HealthResult {
+	start := time.Now()
+
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	// Some checks cannot be interrupted; do not wait for them past the
+	// timeout.
+	errs := make(chan error, 1)
+
+	go func() {
+		errs <- c.Check(ctx)
+	}()
+
+	var err error
+
+	select {
+	case err = <-errs:
+	case <-ctx.Done():
+		err = fmt.Errorf("timed out after %v", c.Timeout)
+	}
+
+	if err != nil {
+		log.Printf("Health check %s failed: %v", c.Name, err)
+	}
+
+	return HealthResult{
+		Name:    c.Name,
+		Err:     err,
+		LastRun: start,
+		Latency: time.Since(start),
+	}
+}
+
+// healthBackoff returns the delay before re-running a check with the given
+// interval after failures consecutive failures.
+func healthBackoff(failures int, interval time.Duration) time.Duration {
+	if failures == 0 {
+		return interval
+	}
+
+	backoff := minHealthBackoff
+
+	for i := 1; i < failures && backoff < interval; i++ {
+		backoff *= 2
+	}
+
+	if backoff > interval {
+		return interval
+	}
+
+	return backoff
+}
+
+// HealthRegistry holds the health checks of the server. The checks are run in
+// the background by Run, which publishes their results as a snapshot; readers
+// never wait for a check. While draining, the server is reported as not ready
+// regardless of the checks.
+type HealthRegistry struct {
+	checks   []HealthCheck
+	draining int32
+
+	// results holds a []HealthResult, in registration order. It is replaced
+	// as a whole by each publication.
+	results atomic.Value
+
+	m sync.Mutex
+}
+
+// SetDraining marks the server as draining, e.g. while shutting down, or not.
+func (hr *HealthRegistry) SetDraining(draining bool) {
+	var v int32
+
+	if draining {
+		v = 1
+	}
+
+	atomic.StoreInt32(&hr.draining, v)
+}
+
+// Draining returns true if the server is draining.
+func (hr *HealthRegistry) Draining() bool {
+	return atomic.LoadInt32(&hr.draining) == 1
+}
+
+// Register adds c to the registry; it must be called before Run. The interval
+// and timeout of c default to DefaultHealthInterval and DefaultHealthTimeout.
+func (hr *HealthRegistry) Register(c HealthCheck) error {
+	if c.Name == "" || c.Check == nil {
+		return errors.New("a health check needs a name and a function")
+	}
+
+	if c.Interval <= 0 {
+		c.Interval = DefaultHealthInterval
+	}
+
+	if c.Timeout <= 0 {
+		c.Timeout = DefaultHealthTimeout
+	}
+
+	hr.m.Lock()
+	defer hr.m.Unlock()
+
+	for _, registered := range hr.checks {
+		if registered.Name == c.Name {
+			return fmt.Errorf("%s: health check already registered", c.Name)
+		}
+	}
+
+	hr.checks = append(hr.checks, c)
+
+	results := append(hr.Results(), HealthResult{Name: c.Name, Err: errNotChecked})
+	hr.results.Store(results)
+
+	return nil
+}
+
+// Results returns the last result of every check, in registration order. The
+// returned slice must not be modified.
+func (hr *HealthRegistry) Results() []HealthResult {
+	results, _ := hr.results.Load().([]HealthResult)
+	return results
+}
+
+// publish replaces the result of the i-th check.
+func (hr *HealthRegistry) publish(i int, res HealthResult) {
+	hr.m.Lock()
+	defer hr.m.Unlock()
+
+	old := hr.Results()
+	results := make([]HealthResult, len(old))
+
+	copy(results, old)
+	results[i] = res
+
+	hr.results.Store(results)
+}
+
+// Run runs every check right away, then again after its interval, or sooner
+// with a growing backoff while it fails. It returns once ctx is done and the
+// running checks have returned or timed out.
+func (hr *HealthRegistry) Run(ctx context.Context) {
+	hr.m.Lock()
+	checks := append([]HealthCheck(nil), hr.checks...)
+	hr.m.Unlock()
+
+	var wg sync.WaitGroup
+
+	for i, c := range checks {
+		wg.Add(1)
+
+		go func(i int, c HealthCheck) {
+			defer wg.Done()
+
+			failures := 0
+
+			for {
+				res := runHealthCheck(ctx, c)
+
+				// Do not publish the failure caused by the shutdown
+				if ctx.Err() != nil {
+					return
+				}
+
+				hr.publish(i, res)
+
+				if res.Err != nil {
+					failures++
+				} else {
+					failures = 0
+				}
+
+				timer := time.NewTimer(healthBackoff(failures, c.Interval))
+
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return
+				case <-timer.C:
+				}
+			}
+		}(i, c)
+	}
+
+	wg.Wait()
+}
+
+const (
+	healthStatusDraining = "draining"
+	healthStatusFailing  = "failing"
+	healthStatusOK       = "ok"
+)
 
 type (
-	healthCache struct {
-		lastCheck time.Time
-		value     bool
+	healthCheckReport struct {
+		Name    string `json:"name"`
+		Status  string `json:"status"`
+		LastRun string `json:"lastRun,omitempty"`
+		Latency string `json:"latency,omitempty"`
+		Error   string `json:"error,omitempty"`
+	}
 
-		m sync.Mutex
+	healthReport struct {
+		Status string              `json:"status"`
+		Checks []healthCheckReport `json:"checks,omitempty"`
 	}
 
+	// health serves the liveness of the process if registry is nil, and the
+	// readiness of the server otherwise.
 	health struct {
-		cache       *healthCache
-		dnsQueryier func(string) ([]string, error)
+		registry *HealthRegistry
 	}
 )
 
-func Health() http.Handler {
-	return &health{
-		cache:       &healthCache{},
-		dnsQueryier: net.LookupTXT,
-	}
+// Liveness returns a handler replying HTTP 200 as long as the process is able
+// to serve requests.
+func Liveness() http.Handler {
+	return &health{}
 }
 
-func (h *health) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	const fqdn = "ping.quba.fr"
+// Readiness returns a handler replying HTTP 200 if the last run of all the
+// checks in registry passed, HTTP 500 if one fails, and HTTP 503 while draining.
+func Readiness(registry *HealthRegistry) http.Handler {
+	return &health{registry: registry}
+}
 
-	log.Printf("Last DNS lookup: %v", h.cache.lastCheck.String())
+func (h *health) report() (healthReport, int) {
+	report := healthReport{Status: healthStatusOK}
 
-	now := time.Now()
+	if h.registry == nil {
+		return report, http.StatusOK
+	}
 
-	if now.Sub(h.cache.lastCheck) <= secondsBetweenChecks*time.Second {
-		log.Print("Using cache")
-	} else {
-		log.Printf("Older than %d seconds; cache invalidated", secondsBetweenChecks)
+	status := http.StatusOK
 
-		records, err := h.dnsQueryier(fqdn)
-		if err != nil {
-			log.Print(err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+	for _, res := range h.registry.Results() {
+		c := healthCheckReport{
+			Name:   res.Name,
+			Status: healthStatusOK,
 		}
 
-		if len(records) != 1 {
-			log.Printf("%s/TXT: not enough records", fqdn)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+		if !res.LastRun.IsZero() {
+			c.LastRun = res.LastRun.UTC().Format(time.RFC3339)
+			c.Latency = res.Latency.String()
 		}
 
-		const expected = "quentin@quba.fr"
-		got := records[0]
+		if res.Err != nil {
+			c.Status = healthStatusFailing
+			c.Error = res.Err.Error()
 
-		h.cache.m.Lock()
-
-		if got != expected {
-			log.Printf("Expected %s, got %s", expected, got)
-			h.cache.value = false
-		} else {
-			h.cache.value = true
+			report.Status = healthStatusFailing
+			status = http.StatusInternalServerError
 		}
 
-		h.cache.lastCheck = now
+		report.Checks = append(report.Checks, c)
+	}
 
-		h.cache.m.Unlock()
+	if h.registry.Draining() {
+		report.Status = healthStatusDraining
+		status = http.StatusServiceUnavailable
 	}
 
-	if !h.cache.value {
-		w.WriteHeader(http.StatusInternalServerError)
-	} else {
-		w.WriteHeader(http.StatusOK)
+	return report, status
+}
+
+// ServeHTTP replies with the status only, or with the JSON report of every
+// check if the verbose query parameter is set.
+func (h *health) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	report, status := h.report()
+
+	if _, ok := r.URL.Query()["verbose"]; !ok {
+		w.WriteHeader(status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		log.Printf("could not write the reply: %v", err)
 	}
 }
@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+
+	img "git.quba.fr/qbarrand/quba.fr-server/pkg/image"
+)
+
+// dnsResolver is implemented by *net.Resolver.
+type dnsResolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// dnsCheck looks up the records of the given type for name with resolver.
+func dnsCheck(resolver dnsResolver, name, recordType, expected string) (func(context.Context) error, error) {
+	var lookup func(context.Context) ([]string, error)
+
+	switch strings.ToUpper(recordType) {
+	case "A":
+		lookup = func(ctx context.Context) ([]string, error) {
+			addrs, err := resolver.LookupIPAddr(ctx, name)
+			if err != nil {
+				return nil, err
+			}
+
+			var records []string
+
+			for _, addr := range addrs {
+				if ip4 := addr.IP.To4(); ip4 != nil {
+					records = append(records, ip4.String())
+				}
+			}
+
+			return records, nil
+		}
+	case "TXT":
+		lookup = func(ctx context.Context) ([]string, error) {
+			return resolver.LookupTXT(ctx, name)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported DNS record type %q", recordType)
+	}
+
+	return func(ctx context.Context) error {
+		records, err := lookup(ctx)
+		if err != nil {
+			return err
+		}
+
+		if len(records) == 0 {
+			return fmt.Errorf("%s/%s: no records", name, recordType)
+		}
+
+		if expected == "" {
+			return nil
+		}
+
+		for _, r := range records {
+			if r == expected {
+				return nil
+			}
+		}
+
+		return fmt.Errorf("%s/%s: expected %s, got %v", name, recordType, expected, records)
+	}, nil
+}
+
+// DNSCheck returns a check looking up the A or TXT records of name. If
+// expected is not empty, one of the records must be equal to it.
+func DNSCheck(name, recordType, expected string) (func(context.Context) error, error) {
+	return dnsCheck(net.DefaultResolver, name, recordType, expected)
+}
+
+// DirReadableCheck returns a check listing dir.
+func DirReadableCheck(dir string) func(context.Context) error {
+	return func(context.Context) error {
+		fd, err := os.Open(dir)
+		if err != nil {
+			return err
+		}
+		defer fd.Close()
+
+		if _, err := fd.Readdirnames(1); err != nil && err != io.EOF {
+			return fmt.Errorf("could not list %s: %v", dir, err)
+		}
+
+		return nil
+	}
+}
+
+// DirWritableCheck returns a check creating and removing a file in dir. The
+// directory is created if needed.
+func DirWritableCheck(dir string) func(context.Context) error {
+	return func(context.Context) error {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+
+		fd, err := ioutil.TempFile(dir, ".health-")
+		if err != nil {
+			return err
+		}
+
+		closeErr := fd.Close()
+
+		if err := os.Remove(fd.Name()); err != nil {
+			return err
+		}
+
+		return closeErr
+	}
+}
+
+// ImageMagickCheck checks that ImageMagick is initialized and can encode an
+// image.
+func ImageMagickCheck(context.Context) error {
+	return img.SelfTest()
+}
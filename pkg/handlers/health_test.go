@@ -1,125 +1,417 @@
 package handlers
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
-func TestHealth(t *testing.T) {
-	if Health() == nil {
-		t.Fatal("Should not return nil")
+func TestLiveness(t *testing.T) {
+	w := httptest.NewRecorder()
+
+	Liveness().ServeHTTP(w, httptest.NewRequest("GET", "/livez?verbose", nil))
+
+	res := w.Result()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Got HTTP %d", res.StatusCode)
+	}
+
+	if b, _ := ioutil.ReadAll(res.Body); string(b) != "{\"status\":\"ok\"}\n" {
+		t.Fatalf("Unexpected body %s", b)
+	}
+}
+
+// checkOnce runs the checks of registry in the background until they all ran
+// once.
+func checkOnce(t *testing.T, registry *HealthRegistry) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		registry.Run(ctx)
+		close(done)
+	}()
+
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for {
+		ran := true
+
+		for _, res := range registry.Results() {
+			if res.LastRun.IsZero() {
+				ran = false
+			}
+		}
+
+		if ran {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("The checks did not run")
+		}
+
+		time.Sleep(time.Millisecond)
 	}
 }
 
-func TestHealth_ServeHTTP(t *testing.T) {
+func TestReadiness_ServeHTTP(t *testing.T) {
 	req := httptest.NewRequest("GET", "/health", nil)
 
-	t.Run("empty DNS records: HTTP 500", func(t *testing.T) {
-		w := httptest.NewRecorder()
+	get := func(t *testing.T, checks ...HealthCheck) int {
+		registry := &HealthRegistry{}
 
-		handler := &health{
-			cache: &healthCache{},
-			dnsQueryier: func(_ string) ([]string, error) {
-				return nil, nil
-			},
+		for _, c := range checks {
+			if err := registry.Register(c); err != nil {
+				t.Fatal(err)
+			}
 		}
 
-		handler.ServeHTTP(w, req)
-		res := w.Result()
+		checkOnce(t, registry)
 
-		if res.StatusCode != http.StatusInternalServerError {
-			t.Fatalf("Got HTTP %d", res.StatusCode)
+		w := httptest.NewRecorder()
+
+		Readiness(registry).ServeHTTP(w, req)
+
+		return w.Result().StatusCode
+	}
+
+	ok := func(context.Context) error { return nil }
+	failing := func(context.Context) error { return errors.New("random error") }
+
+	t.Run("no checks: HTTP 200", func(t *testing.T) {
+		if status := get(t); status != http.StatusOK {
+			t.Fatalf("Got HTTP %d", status)
 		}
 	})
 
-	t.Run("too many DNS records: HTTP 500", func(t *testing.T) {
-		w := httptest.NewRecorder()
+	t.Run("all checks pass: HTTP 200", func(t *testing.T) {
+		if status := get(t, HealthCheck{Name: "a", Check: ok}, HealthCheck{Name: "b", Check: ok}); status != http.StatusOK {
+			t.Fatalf("Got HTTP %d", status)
+		}
+	})
 
-		handler := &health{
-			cache: &healthCache{},
-			dnsQueryier: func(_ string) ([]string, error) {
-				return []string{"a", "b"}, nil
-			},
+	t.Run("one check fails: HTTP 500", func(t *testing.T) {
+		if status := get(t, HealthCheck{Name: "a", Check: ok}, HealthCheck{Name: "b", Check: failing}); status != http.StatusInternalServerError {
+			t.Fatalf("Got HTTP %d", status)
 		}
+	})
 
-		handler.ServeHTTP(w, req)
-		res := w.Result()
+	t.Run("check timing out: HTTP 500", func(t *testing.T) {
+		hanging := func(context.Context) error {
+			time.Sleep(time.Second)
+			return nil
+		}
 
-		if res.StatusCode != http.StatusInternalServerError {
-			t.Fatalf("Got HTTP %d", res.StatusCode)
+		if status := get(t, HealthCheck{Name: "a", Check: hanging, Timeout: 10 * time.Millisecond}); status != http.StatusInternalServerError {
+			t.Fatalf("Got HTTP %d", status)
 		}
 	})
 
-	t.Run("DNS query error: HTTP 500", func(t *testing.T) {
-		w := httptest.NewRecorder()
+	t.Run("checks not run yet: HTTP 500", func(t *testing.T) {
+		registry := &HealthRegistry{}
 
-		handler := &health{
-			cache: &healthCache{},
-			dnsQueryier: func(_ string) ([]string, error) {
-				return nil, errors.New("whatever")
-			},
+		if err := registry.Register(HealthCheck{Name: "a", Check: ok}); err != nil {
+			t.Fatal(err)
 		}
 
-		handler.ServeHTTP(w, req)
-		res := w.Result()
+		w := httptest.NewRecorder()
 
-		if res.StatusCode != http.StatusInternalServerError {
+		Readiness(registry).ServeHTTP(w, req)
+
+		if res := w.Result(); res.StatusCode != http.StatusInternalServerError {
 			t.Fatalf("Got HTTP %d", res.StatusCode)
 		}
 	})
+}
 
-	t.Run("should query ping.quba.fr", func(t *testing.T) {
-		w := httptest.NewRecorder()
+func TestReadiness_verbose(t *testing.T) {
+	registry := &HealthRegistry{}
 
-		handler := &health{
-			cache: &healthCache{},
-			dnsQueryier: func(q string) ([]string, error) {
-				if q != "ping.quba.fr" {
-					t.Fatalf("Queried %s", q)
-				}
+	checks := []HealthCheck{
+		{Name: "ok", Check: func(context.Context) error { return nil }},
+		{Name: "failing", Check: func(context.Context) error { return errors.New("random error") }},
+	}
 
-				return nil, nil
-			},
+	for _, c := range checks {
+		if err := registry.Register(c); err != nil {
+			t.Fatal(err)
 		}
+	}
 
-		handler.ServeHTTP(w, req)
-	})
+	checkOnce(t, registry)
 
-	t.Run("unexpected TXT contents: HTTP 500", func(t *testing.T) {
+	get := func(t *testing.T) (int, healthReport) {
 		w := httptest.NewRecorder()
 
-		handler := &health{
-			cache: &healthCache{},
-			dnsQueryier: func(_ string) ([]string, error) {
-				return []string{"test"}, nil
-			},
-		}
+		Readiness(registry).ServeHTTP(w, httptest.NewRequest("GET", "/readyz?verbose", nil))
 
-		handler.ServeHTTP(w, req)
 		res := w.Result()
 
-		if res.StatusCode != http.StatusInternalServerError {
-			t.Fatalf("Got HTTP %d", res.StatusCode)
+		if ct := res.Header.Get("Content-Type"); ct != "application/json" {
+			t.Fatalf("Unexpected Content-Type %q", ct)
+		}
+
+		var report healthReport
+
+		if err := json.NewDecoder(res.Body).Decode(&report); err != nil {
+			t.Fatal(err)
+		}
+
+		return res.StatusCode, report
+	}
+
+	status, report := get(t)
+
+	if status != http.StatusInternalServerError || report.Status != "failing" || len(report.Checks) != 2 {
+		t.Fatalf("Unexpected report: HTTP %d, %+v", status, report)
+	}
+
+	if c := report.Checks[0]; c.Name != "ok" || c.Status != "ok" || c.Error != "" || c.LastRun == "" || c.Latency == "" {
+		t.Fatalf("Unexpected check report %+v", c)
+	}
+
+	if c := report.Checks[1]; c.Name != "failing" || c.Status != "failing" || c.Error != "random error" {
+		t.Fatalf("Unexpected check report %+v", c)
+	}
+
+	t.Run("draining: HTTP 503", func(t *testing.T) {
+		registry.SetDraining(true)
+		defer registry.SetDraining(false)
+
+		if status, report := get(t); status != http.StatusServiceUnavailable || report.Status != "draining" {
+			t.Fatalf("Unexpected report: HTTP %d, %+v", status, report)
 		}
 	})
+}
 
-	t.Run("expected TXT contents: HTTP 200", func(t *testing.T) {
-		w := httptest.NewRecorder()
+func TestHealthRegistry(t *testing.T) {
+	t.Run("duplicate name", func(t *testing.T) {
+		registry := &HealthRegistry{}
+
+		if err := registry.Register(HealthCheck{Name: "a", Check: ImageMagickCheck}); err != nil {
+			t.Fatal(err)
+		}
 
-		handler := &health{
-			cache: &healthCache{},
-			dnsQueryier: func(_ string) ([]string, error) {
-				return []string{"quentin@quba.fr"}, nil
+		if err := registry.Register(HealthCheck{Name: "a", Check: ImageMagickCheck}); err == nil {
+			t.Fatal("Expected an error")
+		}
+	})
+
+	t.Run("checks are run in the background until stopped", func(t *testing.T) {
+		registry := &HealthRegistry{}
+
+		var runs int32
+
+		check := HealthCheck{
+			Name: "a",
+			Check: func(context.Context) error {
+				atomic.AddInt32(&runs, 1)
+				return nil
 			},
+			Interval: 5 * time.Millisecond,
 		}
 
-		handler.ServeHTTP(w, req)
-		res := w.Result()
+		if err := registry.Register(check); err != nil {
+			t.Fatal(err)
+		}
 
-		if res.StatusCode != http.StatusOK {
-			t.Fatalf("Got HTTP %d", res.StatusCode)
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+
+		go func() {
+			registry.Run(ctx)
+			close(done)
+		}()
+
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Run did not return")
+		}
+
+		if n := atomic.LoadInt32(&runs); n < 2 {
+			t.Fatalf("Expected several runs, got %d", n)
+		}
+
+		if results := registry.Results(); len(results) != 1 || results[0].Err != nil || results[0].LastRun.IsZero() {
+			t.Fatalf("Unexpected results %+v", results)
 		}
 	})
 }
+
+func Test_healthBackoff(t *testing.T) {
+	cases := []struct {
+		failures int
+		expected time.Duration
+	}{
+		{failures: 0, expected: time.Minute},
+		{failures: 1, expected: time.Second},
+		{failures: 2, expected: 2 * time.Second},
+		{failures: 4, expected: 8 * time.Second},
+		{failures: 10, expected: time.Minute},
+	}
+
+	for _, c := range cases {
+		if got := healthBackoff(c.failures, time.Minute); got != c.expected {
+			t.Fatalf("%d failures: expected %v, got %v", c.failures, c.expected, got)
+		}
+	}
+}
+
+func TestReadHealthConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "health.json")
+
+	write := func(t *testing.T, contents string) {
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(t, `[{"name": "dns", "interval": "1m", "timeout": "2s"}, {"name": "dir", "timeout": "1s"}]`)
+
+	timings, err := ReadHealthConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if timings["dns"] != (HealthCheckTimings{Interval: time.Minute, Timeout: 2 * time.Second}) || timings["dir"] != (HealthCheckTimings{Timeout: time.Second}) {
+		t.Fatalf("Unexpected timings %v", timings)
+	}
+
+	write(t, `[{"name": "dns", "interval": "-1m"}]`)
+
+	if _, err := ReadHealthConfig(path); err == nil {
+		t.Fatal("Expected an error")
+	}
+}
+
+type fakeResolver struct {
+	addrs   []net.IPAddr
+	records []string
+	err     error
+	queried string
+}
+
+func (f *fakeResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	f.queried = host
+	return f.addrs, f.err
+}
+
+func (f *fakeResolver) LookupTXT(_ context.Context, name string) ([]string, error) {
+	f.queried = name
+	return f.records, f.err
+}
+
+func Test_dnsCheck(t *testing.T) {
+	cases := map[string]struct {
+		resolver   fakeResolver
+		recordType string
+		expected   string
+		ok         bool
+	}{
+		"TXT: expected value": {
+			resolver:   fakeResolver{records: []string{"other", "quentin@quba.fr"}},
+			recordType: "TXT",
+			expected:   "quentin@quba.fr",
+			ok:         true,
+		},
+		"TXT: unexpected value": {
+			resolver:   fakeResolver{records: []string{"test"}},
+			recordType: "TXT",
+			expected:   "quentin@quba.fr",
+		},
+		"TXT: no records": {
+			recordType: "txt",
+		},
+		"TXT: lookup error": {
+			resolver:   fakeResolver{err: errors.New("whatever")},
+			recordType: "TXT",
+		},
+		"A: any value": {
+			resolver:   fakeResolver{addrs: []net.IPAddr{{IP: net.ParseIP("::1")}, {IP: net.ParseIP("192.0.2.1")}}},
+			recordType: "A",
+			ok:         true,
+		},
+		"A: only IPv6 addresses": {
+			resolver:   fakeResolver{addrs: []net.IPAddr{{IP: net.ParseIP("::1")}}},
+			recordType: "A",
+		},
+		"A: unexpected value": {
+			resolver:   fakeResolver{addrs: []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}}},
+			recordType: "A",
+			expected:   "192.0.2.2",
+		},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			check, err := dnsCheck(&c.resolver, "ping.example.com", c.recordType, c.expected)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := check(context.Background()); (err == nil) != c.ok {
+				t.Fatalf("Unexpected result %v", err)
+			}
+
+			if c.resolver.queried != "ping.example.com" {
+				t.Fatalf("Queried %q", c.resolver.queried)
+			}
+		})
+	}
+
+	if _, err := dnsCheck(&fakeResolver{}, "ping.example.com", "MX", ""); err == nil {
+		t.Fatal("Expected an error for an unsupported record type")
+	}
+}
+
+func TestDirChecks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := DirReadableCheck(dir)(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := DirReadableCheck(filepath.Join(dir, "missing"))(context.Background()); err == nil {
+		t.Fatal("Expected an error for a missing directory")
+	}
+
+	cacheDir := filepath.Join(dir, "cache")
+
+	if err := DirWritableCheck(cacheDir)(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if entries, err := ioutil.ReadDir(cacheDir); err != nil || len(entries) != 0 {
+		t.Fatalf("The directory should be created and left empty, got %v, %v", entries, err)
+	}
+}
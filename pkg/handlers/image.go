@@ -1,9 +1,12 @@
 package handlers
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -11,6 +14,14 @@ import (
 	img "git.quba.fr/qbarrand/quba.fr-server/pkg/image"
 )
 
+// variantFormats maps the ImageMagick formats images can be rendered to, as
+// returned by getPreferredIMFormat, to their MIME type.
+var variantFormats = map[string]string{
+	"jpg":  "image/jpeg",
+	"jxr":  "image/jxr",
+	"webp": "image/webp",
+}
+
 func getPreferredIMFormat(accept string) (string, string) {
 	for _, mimeType := range strings.Split(accept, ",") {
 		mimeType = strings.Trim(mimeType, " ")
@@ -62,16 +73,77 @@ func parseDimensions(r *http.Request) (uint, uint, error) {
 	return height, width, nil
 }
 
+// preferMeta returns true if the Prefer header of r contains the meta
+// preference (RFC 7240).
+func preferMeta(r *http.Request) bool {
+	for _, prefer := range r.Header["Prefer"] {
+		for _, pref := range strings.Split(prefer, ",") {
+			name := strings.SplitN(strings.SplitN(pref, ";", 2)[0], "=", 2)[0]
+
+			if strings.EqualFold(strings.TrimSpace(name), "meta") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// ImageOptions configures the Image handler.
+type ImageOptions struct {
+	// CacheDir is where rendered variants are stored. If empty, they are
+	// rendered for every request.
+	CacheDir string
+
+	// CacheMaxBytes is the size above which the least recently used
+	// variants are removed from CacheDir; 0 means unlimited.
+	CacheMaxBytes int64
+
+	Colors   img.ColorOptions
+	Metadata img.MetadataPolicy
+
+	Quality uint
+}
+
+// Variant describes how an image is rendered.
+type Variant struct {
+	// Format is the ImageMagick output format, e.g. webp.
+	Format string
+
+	// Height and Width are the requested dimensions. At most one of them is
+	// set; if both are 0, the image keeps its size.
+	Height uint
+	Width  uint
+}
+
+// sourceMeta holds the values sent in the X-* headers. They only depend on the
+// source file, and are computed once per file.
+type sourceMeta struct {
+	date        string
+	location    string
+	mainColor   string
+	palette     img.Palette
+	placeholder img.Placeholder
+
+	// err is set if the metadata could not be computed. Failures are cached
+	// too, so that they are not retried until the file changes.
+	err error
+}
+
 type Image struct {
 	baseDir             string
 	bytesHasher         func([]byte) (string, error)
-	imageControllerCtor func(string) (imageController, error)
-	quality             uint
+	imageControllerCtor func(context.Context, string) (imageController, error)
+	metaHeaders         bool
+	metas               *sourceCache
+	opts                ImageOptions
+	placeholders        *sourceCache
+	variants            *variantCache
 }
 
-func NewImage(baseDir string, quality uint) *Image {
-	imageProcessorCtor := func(path string) (imageController, error) {
-		p, err := img.NewImagickProcessor(path)
+func NewImage(baseDir string, opts ImageOptions) *Image {
+	imageProcessorCtor := func(ctx context.Context, path string) (imageController, error) {
+		p, err := img.NewImagickProcessor(ctx, path)
 		if err != nil {
 			return nil, err
 		}
@@ -83,11 +155,250 @@ func NewImage(baseDir string, quality uint) *Image {
 		baseDir:             baseDir,
 		bytesHasher:         hashBytes,
 		imageControllerCtor: imageProcessorCtor,
-		quality:             quality,
+		metas:               newSourceCache(),
+		opts:                opts,
+		placeholders:        newSourceCache(),
+		variants:            newVariantCache(opts.CacheDir, opts.CacheMaxBytes),
+	}
+}
+
+// Close discards the variants still being written to the cache, and stops
+// caching new ones. It must be called once no request is being served.
+func (i Image) Close() {
+	if i.variants != nil {
+		i.variants.close()
+	}
+}
+
+// WithMetaHeaders returns a handler for the same images that sends the X-*
+// metadata headers with every image, for the routes of pages that use them.
+// Otherwise, they are only sent when requested with ?meta=1 or "Prefer: meta".
+// Both handlers share their caches.
+func (i *Image) WithMetaHeaders() *Image {
+	withMeta := *i
+	withMeta.metaHeaders = true
+
+	return &withMeta
+}
+
+// Metadata returns an ImageMetadata handler for the same images, sharing the
+// metadata computed from the source files.
+func (i *Image) Metadata() *ImageMetadata {
+	im := NewImageMetadata(i.baseDir, i.opts.Metadata)
+	im.metas = i.metas
+	im.placeholders = i.placeholders
+
+	return im
+}
+
+// cachedSourceMeta returns the metadata of the image at path from cache, or
+// computes it with p. It must be called before the metadata is stripped.
+func cachedSourceMeta(metas, placeholders *sourceCache, path string, fi os.FileInfo, p imageController) (sourceMeta, error) {
+	v, err := metas.getOrCompute(path, fi, func() (interface{}, error) {
+		sm := sourceMeta{
+			date:     p.ExifField("comment"),
+			location: p.ExifField("Iptc4xmpCore:Location"),
+		}
+
+		var err error
+
+		if sm.palette, err = p.Palette(paletteSize); err != nil {
+			return nil, fmt.Errorf("could not get the palette: %v", err)
+		}
+
+		// The main color is the dominant color of the palette, as returned by
+		// MainColor; the palette is computed once for both.
+		if len(sm.palette.Colors) > 0 {
+			sm.mainColor = sm.palette.Colors[0].String()
+		}
+
+		if sm.placeholder, err = cachedPlaceholder(placeholders, path, fi, p); err != nil {
+			return nil, fmt.Errorf("could not compute the placeholder: %v", err)
+		}
+
+		return sm, nil
+	})
+	if err != nil {
+		return sourceMeta{}, err
+	}
+
+	sm := v.(sourceMeta)
+
+	return sm, sm.err
+}
+
+// cacheSourceMetaError caches err as the metadata of the image at path,
+// unless r was cancelled: the failure may then not happen again.
+func cacheSourceMetaError(metas *sourceCache, r *http.Request, path string, fi os.FileInfo, err error) {
+	if !requestCancelled(r) {
+		metas.set(path, fi, sourceMeta{err: err})
+	}
+}
+
+// etag identifies the response to a request without encoding it, as the bytes
+// only depend on the source file and on how it is rendered.
+func (i Image) etag(path string, fi os.FileInfo, v Variant) (string, error) {
+	key := fmt.Sprintf(
+		"%s\x00%d\x00%d\x00%s\x00%dx%d\x00%+v\x00%d\x00%d",
+		path,
+		fi.Size(),
+		fi.ModTime().UnixNano(),
+		v.Format,
+		v.Width,
+		v.Height,
+		i.opts.Colors,
+		i.opts.Metadata,
+		i.opts.Quality,
+	)
+
+	return i.bytesHasher([]byte(key))
+}
+
+// servePlaceholder replies with a blurred SVG placeholder of the image.
+func (i Image) servePlaceholder(w http.ResponseWriter, r *http.Request, imagePath string) {
+	// If the file cannot be stat'ed, fi is nil and nothing is cached
+	fi, _ := os.Stat(imagePath)
+
+	v, ok := i.placeholders.get(imagePath, fi)
+	ph, _ := v.(img.Placeholder)
+
+	if !ok {
+		p, err := i.imageControllerCtor(r.Context(), imagePath)
+		if err != nil {
+			if requestCancelled(r) {
+				return
+			}
+
+			log.Printf("could not create the image controller: %v", err)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		defer p.Destroy()
+
+		if ph, err = cachedPlaceholder(i.placeholders, imagePath, fi, p); err != nil {
+			if requestCancelled(r) {
+				return
+			}
+
+			log.Printf("Could not compute the placeholder: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	svg := placeholderSVG(ph)
+
+	hash, err := i.bytesHasher(svg)
+	if err != nil {
+		log.Printf("Could not hash the reponse bytes: %v", err)
+	} else if r.Header.Get("If-None-Match") == hash {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	headers := w.Header()
+	headers.Set("ETag", hash)
+	headers.Set("Content-Length", strconv.Itoa(len(svg)))
+	headers.Set("Content-Type", "image/svg+xml")
+
+	if _, err := w.Write(svg); err != nil {
+		log.Printf("could not write the reply: %v", err)
+	}
+}
+
+// render applies the rendering options and v to the image of p, without
+// encoding it.
+func (i Image) render(p imageController, v Variant) error {
+	if i.opts.Metadata != img.KeepAll {
+		if err := p.StripMetadata(i.opts.Metadata); err != nil {
+			return fmt.Errorf("could not strip the metadata: %v", err)
+		}
+	}
+
+	if v.Height != 0 || v.Width != 0 {
+		if err := p.Resize(v.Height, v.Width); err != nil {
+			return fmt.Errorf("could not resize the image: %v", err)
+		}
+	}
+
+	if i.opts.Colors.ConvertToSRGB {
+		if err := p.ConvertToSRGB(i.opts.Colors.KeepProfile); err != nil {
+			return fmt.Errorf("could not convert the image to sRGB: %v", err)
+		}
+	}
+
+	if err := p.SetQuality(i.opts.Quality); err != nil {
+		log.Printf("Could not set the quality to %d: %v", i.opts.Quality, err)
 	}
+
+	if err := p.Convert(v.Format); err != nil {
+		return fmt.Errorf("could not convert to %q: %v", v.Format, err)
+	}
+
+	return nil
+}
+
+// setHeaders sets the headers of an image reply.
+func (i Image) setHeaders(w http.ResponseWriter, r *http.Request, mimeType, hash string, meta *sourceMeta) {
+	headers := w.Header()
+	headers.Set("Content-Type", mimeType)
+
+	if hash != "" {
+		headers.Set("ETag", hash)
+	}
+
+	if !i.metaHeaders {
+		headers.Add("Vary", "Prefer")
+	}
+
+	if meta != nil {
+		if preferMeta(r) {
+			headers.Set("Preference-Applied", "meta")
+		}
+
+		headers.Set("X-BlurHash", meta.placeholder.BlurHash)
+		headers.Set("X-Date", meta.date)
+		headers.Set("X-Location", meta.location)
+		headers.Set("X-Main-Color", meta.mainColor)
+		headers.Set("X-Palette", paletteHeader(meta.palette))
+		headers.Set("X-Placeholder", meta.placeholder.Preview)
+	}
+}
+
+// serveCached replies with the cached variant identified by hash. It returns
+// false if the variant is not cached, in which case nothing was written.
+func (i Image) serveCached(w http.ResponseWriter, r *http.Request, mimeType, hash string, meta *sourceMeta) bool {
+	f, err := i.variants.open(hash)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		log.Printf("Could not stat the cached variant: %v", err)
+		return false
+	}
+
+	i.setHeaders(w, r, mimeType, hash, meta)
+	w.Header().Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
+
+	if _, err := io.Copy(w, f); err != nil {
+		log.Printf("could not write the reply: %v", err)
+	}
+
+	return true
 }
 
 func (i Image) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	filePath := r.URL.Path
+	imagePath := filepath.Join(i.baseDir, filePath)
+
+	if r.FormValue("placeholder") == "svg" {
+		i.servePlaceholder(w, r, imagePath)
+		return
+	}
+
 	// Parse the requested dimensions
 	height, width, err := parseDimensions(r)
 	if err != nil {
@@ -102,17 +413,79 @@ func (i Image) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	log.Print("Accept: " + accept)
 
 	mimeType, imFormat := getPreferredIMFormat(accept)
+
+	// An explicit format, e.g. in a <picture> source, takes precedence
+	if format := r.FormValue("format"); format != "" {
+		var ok bool
+
+		if mimeType, ok = variantFormats[format]; !ok {
+			log.Printf("%q: unsupported format", format)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		imFormat = format
+	}
+
 	if imFormat == "" {
 		log.Printf("No accepted format among %q", accept)
 		w.WriteHeader(http.StatusNotAcceptable)
 		return
 	}
 
-	filePath := r.URL.Path
-	imagePath := filepath.Join(i.baseDir, filePath)
+	v := Variant{Format: imFormat, Height: height, Width: width}
+
+	// If the file cannot be stat'ed, fi is nil; nothing is cached and no
+	// ETag is sent.
+	fi, _ := os.Stat(imagePath)
+
+	var hash string
+
+	if fi != nil {
+		if hash, err = i.etag(imagePath, fi, v); err != nil {
+			log.Printf("Could not compute the ETag: %v", err)
+		} else if r.Header.Get("If-None-Match") == hash {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	sendMeta := i.metaHeaders || preferMeta(r)
+
+	if b, err := strconv.ParseBool(r.FormValue("meta")); err == nil {
+		sendMeta = sendMeta || b
+	}
 
-	p, err := i.imageControllerCtor(imagePath)
+	// Serve the rendered variant from cache, unless we need to decode the
+	// image anyway to compute its metadata.
+	if i.variants != nil && hash != "" {
+		var (
+			meta   *sourceMeta
+			cached = true
+		)
+
+		if sendMeta {
+			var m interface{}
+
+			if m, cached = i.metas.get(imagePath, fi); cached {
+				if sm := m.(sourceMeta); sm.err == nil {
+					meta = &sm
+				}
+			}
+		}
+
+		if cached && i.serveCached(w, r, mimeType, hash, meta) {
+			return
+		}
+	}
+
+	// Decoding, resizing and encoding are aborted if the client goes away
+	p, err := i.imageControllerCtor(r.Context(), imagePath)
 	if err != nil {
+		if requestCancelled(r) {
+			return
+		}
+
 		log.Printf("could not create the image controller: %v", err)
 		w.WriteHeader(http.StatusNotFound)
 		return
@@ -121,50 +494,67 @@ func (i Image) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("ImageMagick format: %q", imFormat)
 
-	if height != 0 || width != 0 {
-		if err := p.Resize(height, width); err != nil {
-			log.Printf("Could not resize the Image: %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+	var meta *sourceMeta
+
+	// Read the metadata we expose before it is stripped
+	if sendMeta {
+		sm, err := cachedSourceMeta(i.metas, i.placeholders, imagePath, fi, p)
+		if err != nil {
+			if requestCancelled(r) {
+				return
+			}
+
+			log.Printf("Could not get the image metadata: %v", err)
+			cacheSourceMetaError(i.metas, r, imagePath, fi, err)
+		} else {
+			meta = &sm
 		}
 	}
 
-	if err := p.SetQuality(i.quality); err != nil {
-		log.Printf("Could not set the quality to %d: %v", i.quality, err)
-	}
+	if err := i.render(p, v); err != nil {
+		if requestCancelled(r) {
+			return
+		}
 
-	if err := p.Convert(imFormat); err != nil {
-		log.Printf("Could not convert to %q: %v", imFormat, err)
+		log.Printf("Could not render the image: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	cr, cg, cb, err := p.MainColor()
-	if err != nil {
-		log.Printf("Could not get the main color: %v", err)
-	}
+	i.setHeaders(w, r, mimeType, hash, meta)
 
-	imageBytes := p.Bytes()
+	var (
+		out = io.Writer(w)
+		vw  *variantWriter
+	)
+
+	// Keep a copy of the variant for the next requests
+	if i.variants != nil && hash != "" {
+		if vw, err = i.variants.create(hash); err != nil {
+			log.Printf("Could not cache the variant: %v", err)
+		} else {
+			defer vw.abort()
+			out = vw.tee(w)
+		}
+	}
 
-	hash, err := i.bytesHasher(imageBytes)
+	// The image is streamed as it is encoded; since its length is unknown
+	// beforehand, it is sent with chunked transfer encoding.
+	n, err := p.WriteTo(out)
 	if err != nil {
-		log.Printf("Could not hash the reponse bytes: %v", err)
-	} else if r.Header.Get("If-None-Match") == hash {
-		w.WriteHeader(http.StatusNotModified)
+		if requestCancelled(r) {
+			return
+		}
+
+		log.Printf("could not write the reply after %d bytes: %v", n, err)
 		return
 	}
 
-	headers := w.Header()
-	headers.Set("ETag", hash)
-	headers.Set("Content-Length", strconv.Itoa(len(imageBytes)))
-	headers.Set("Content-Type", mimeType)
-	headers.Set("X-Date", p.ExifField("comment"))
-	headers.Set("X-Location", p.ExifField("Iptc4xmpCore:Location"))
-	headers.Set("X-Main-Color", fmt.Sprintf("#%02X%02X%02X", cr, cg, cb))
+	log.Printf("Wrote %d bytes", n)
 
-	if n, err := w.Write(imageBytes); err != nil {
-		log.Printf("could not write the reply: %v", err)
-	} else {
-		log.Printf("Wrote %d bytes", n)
+	if vw != nil {
+		if err := vw.commit(); err != nil {
+			log.Printf("Could not cache the variant: %v", err)
+		}
 	}
 }
@@ -1,13 +1,24 @@
 package handlers
 
+import (
+	"io"
+
+	img "git.quba.fr/qbarrand/quba.fr-server/pkg/image"
+)
+
 type imageController interface {
-	Bytes() []byte
 	Convert(string) error
+	ConvertToSRGB(bool) error
 	Destroy()
+	Dimensions() (uint, uint)
 	ExifField(string) string
 	Format() string
 	MainColor() (uint, uint, uint, error)
+	Orientation() uint
+	Palette(uint) (img.Palette, error)
+	Placeholder() (img.Placeholder, error)
 	Resize(uint, uint) error
 	SetQuality(uint) error
-	StripEXIF() error
+	StripMetadata(img.MetadataPolicy) error
+	WriteTo(io.Writer) (int64, error)
 }
@@ -0,0 +1,198 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	img "git.quba.fr/qbarrand/quba.fr-server/pkg/image"
+)
+
+// metadataFields are the EXIF and IPTC properties exposed by ImageMetadata,
+// with the most restrictive policy exposing them; policies are ordered from
+// StripAll to KeepAll. They mirror what the policy
+// leaves in served images: the shooting parameters, date and place are always
+// exposed, the author and copyright notice from KeepCopyright on, and the
+// camera and lens only with KeepAll. GPS coordinates, serial numbers and the
+// editing history are never exposed.
+var metadataFields = []struct {
+	name   string
+	policy img.MetadataPolicy
+}{
+	{name: "comment", policy: img.StripAll},
+	{name: "Iptc4xmpCore:Location", policy: img.StripAll},
+	{name: "exif:DateTimeOriginal", policy: img.StripAll},
+	{name: "exif:ExposureTime", policy: img.StripAll},
+	{name: "exif:FNumber", policy: img.StripAll},
+	{name: "exif:FocalLength", policy: img.StripAll},
+	{name: "exif:ISOSpeedRatings", policy: img.StripAll},
+	{name: "IPTC:2:120", policy: img.StripAll},
+	{name: "exif:Artist", policy: img.KeepCopyright},
+	{name: "exif:Copyright", policy: img.KeepCopyright},
+	{name: "IPTC:2:80", policy: img.KeepCopyright},
+	{name: "IPTC:2:116", policy: img.KeepCopyright},
+	{name: "exif:LensModel", policy: img.KeepAll},
+	{name: "exif:Make", policy: img.KeepAll},
+	{name: "exif:Model", policy: img.KeepAll},
+}
+
+type imageMetadata struct {
+	Width       uint              `json:"width"`
+	Height      uint              `json:"height"`
+	Format      string            `json:"format"`
+	Orientation uint              `json:"orientation"`
+	MainColor   string            `json:"mainColor"`
+	Palette     paletteJSON       `json:"palette"`
+	BlurHash    string            `json:"blurHash"`
+	Preview     string            `json:"preview"`
+	Fields      map[string]string `json:"fields"`
+	Size        int64             `json:"size"`
+	ETag        string            `json:"etag"`
+}
+
+// ImageMetadata serves the metadata of an image as JSON. It decodes the image
+// once per source file, but never encodes it.
+type ImageMetadata struct {
+	baseDir             string
+	bytesHasher         func([]byte) (string, error)
+	documents           *sourceCache
+	imageControllerCtor func(context.Context, string) (imageController, error)
+	metas               *sourceCache
+	placeholders        *sourceCache
+	policy              img.MetadataPolicy
+}
+
+// NewImageMetadata returns a handler for the images of baseDir, exposing the
+// fields that policy leaves in served images.
+func NewImageMetadata(baseDir string, policy img.MetadataPolicy) *ImageMetadata {
+	imageProcessorCtor := func(ctx context.Context, path string) (imageController, error) {
+		p, err := img.NewImagickProcessor(ctx, path)
+		if err != nil {
+			return nil, err
+		}
+
+		return imageController(p), nil
+	}
+
+	return &ImageMetadata{
+		baseDir:             baseDir,
+		bytesHasher:         hashBytes,
+		documents:           newSourceCache(),
+		imageControllerCtor: imageProcessorCtor,
+		metas:               newSourceCache(),
+		placeholders:        newSourceCache(),
+		policy:              policy,
+	}
+}
+
+// etag identifies the JSON metadata of the image at path without decoding it,
+// as it only depends on the source file and on the metadata policy.
+func (im ImageMetadata) etag(path string, fi os.FileInfo) (string, error) {
+	key := fmt.Sprintf("%s\x00%d\x00%d\x00%d", path, fi.Size(), fi.ModTime().UnixNano(), im.policy)
+
+	return im.bytesHasher([]byte(key))
+}
+
+// document decodes the image at path and returns its metadata as JSON.
+func (im ImageMetadata) document(r *http.Request, path string, fi os.FileInfo, hash string) ([]byte, error) {
+	p, err := im.imageControllerCtor(r.Context(), path)
+	if err != nil {
+		return nil, fmt.Errorf("could not create the image controller: %v", err)
+	}
+	defer p.Destroy()
+
+	height, width := p.Dimensions()
+
+	meta := imageMetadata{
+		Width:       width,
+		Height:      height,
+		Format:      p.Format(),
+		Orientation: p.Orientation(),
+		Fields:      make(map[string]string),
+		Size:        fi.Size(),
+		ETag:        hash,
+	}
+
+	sm, err := cachedSourceMeta(im.metas, im.placeholders, path, fi, p)
+	if err != nil {
+		log.Printf("Could not get the image metadata: %v", err)
+		cacheSourceMetaError(im.metas, r, path, fi, err)
+	}
+
+	meta.MainColor = sm.mainColor
+	meta.Palette = newPaletteJSON(sm.palette)
+	meta.BlurHash = sm.placeholder.BlurHash
+	meta.Preview = sm.placeholder.Preview
+
+	for _, f := range metadataFields {
+		if f.policy > im.policy {
+			continue
+		}
+
+		if v := p.ExifField(f.name); v != "" {
+			meta.Fields[f.name] = v
+		}
+	}
+
+	// The values above are incomplete if the client went away meanwhile
+	if err := r.Context().Err(); err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+
+	if err := json.NewEncoder(&b).Encode(meta); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+func (im ImageMetadata) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	imagePath := filepath.Join(im.baseDir, r.URL.Path)
+
+	fi, err := os.Stat(imagePath)
+	if err != nil || fi.IsDir() {
+		log.Printf("%s: not a file: %v", imagePath, err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// Conditional requests are answered before decoding anything
+	hash, err := im.etag(imagePath, fi)
+	if err != nil {
+		log.Printf("Could not compute the ETag: %v", err)
+	} else if r.Header.Get("If-None-Match") == hash {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	v, err := im.documents.getOrCompute(imagePath, fi, func() (interface{}, error) {
+		return im.document(r, imagePath, fi, hash)
+	})
+	if err != nil {
+		if requestCancelled(r) {
+			return
+		}
+
+		log.Printf("Could not get the metadata of %s: %v", imagePath, err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	headers := w.Header()
+	headers.Set("Content-Type", "application/json")
+
+	if hash != "" {
+		headers.Set("ETag", hash)
+	}
+
+	if _, err := w.Write(v.([]byte)); err != nil {
+		log.Printf("could not write the reply: %v", err)
+	}
+}
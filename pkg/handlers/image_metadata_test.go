@@ -0,0 +1,273 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+
+	"git.quba.fr/qbarrand/quba.fr-server/pkg/handlers/mock_handlers"
+	img "git.quba.fr/qbarrand/quba.fr-server/pkg/image"
+)
+
+func TestNewImageMetadata(t *testing.T) {
+	if NewImageMetadata("", img.StripAll) == nil {
+		t.Fatal("Should not return nil")
+	}
+}
+
+func TestImageMetadata_ServeHTTP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "image-metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	contents := []byte("not really a JPEG")
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "image.jpg"), contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("non-existing file: HTTP 404", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/non-existent-file.jpg", nil)
+		w := httptest.NewRecorder()
+
+		NewImageMetadata(dir, img.StripAll).ServeHTTP(w, req)
+
+		if res := w.Result(); res.StatusCode != http.StatusNotFound {
+			t.Fatalf("Got HTTP %d", res.StatusCode)
+		}
+	})
+
+	t.Run("matching If-None-Match: HTTP 304", func(t *testing.T) {
+		im := NewImageMetadata(dir, img.StripAll)
+		im.imageControllerCtor = func(context.Context, string) (imageController, error) {
+			t.Fatal("The image should not be decoded")
+			return nil, nil
+		}
+
+		path := filepath.Join(dir, "image.jpg")
+
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hash, err := im.etag(path, fi)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/image.jpg", nil)
+		req.Header.Set("If-None-Match", hash)
+
+		w := httptest.NewRecorder()
+
+		im.ServeHTTP(w, req)
+
+		if res := w.Result(); res.StatusCode != http.StatusNotModified {
+			t.Fatalf("Got HTTP %d", res.StatusCode)
+		}
+	})
+
+	t.Run("JSON metadata", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/image.jpg", nil)
+		w := httptest.NewRecorder()
+
+		controller := gomock.NewController(t)
+		mockIC := mock_handlers.NewMockimageController(controller)
+
+		im := NewImageMetadata(dir, img.StripAll)
+		im.imageControllerCtor = func(context.Context, string) (imageController, error) {
+			return mockIC, nil
+		}
+
+		mockIC.EXPECT().Dimensions().Return(uint(600), uint(800))
+		mockIC.EXPECT().Format().Return("JPEG")
+		mockIC.EXPECT().Orientation().Return(uint(6))
+		mockIC.EXPECT().Palette(uint(paletteSize)).Return(img.Palette{
+			Colors:  []img.PaletteColor{{Color: img.Color{R: 1, G: 2, B: 3}, Weight: 1}},
+			Vibrant: img.Color{R: 1, G: 2, B: 3},
+			Muted:   img.Color{R: 1, G: 2, B: 3},
+			Text:    img.Color{R: 255, G: 255, B: 255},
+		}, nil)
+		mockIC.EXPECT().Placeholder().Return(img.Placeholder{BlurHash: "00FF0080"}, nil)
+		mockIC.EXPECT().ExifField("comment").Return("2019-09-21").AnyTimes()
+		mockIC.EXPECT().ExifField(gomock.Any()).AnyTimes()
+		mockIC.EXPECT().Destroy()
+
+		im.ServeHTTP(w, req)
+
+		res := w.Result()
+
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("Got HTTP %d", res.StatusCode)
+		}
+
+		if ct := res.Header.Get("Content-Type"); ct != "application/json" {
+			t.Fatalf("Unexpected Content-Type %q", ct)
+		}
+
+		var meta imageMetadata
+
+		if err := json.NewDecoder(res.Body).Decode(&meta); err != nil {
+			t.Fatal(err)
+		}
+
+		if meta.Width != 800 || meta.Height != 600 {
+			t.Fatalf("Unexpected dimensions %dx%d", meta.Width, meta.Height)
+		}
+
+		if meta.MainColor != "#010203" {
+			t.Fatalf("Unexpected main color %q", meta.MainColor)
+		}
+
+		if c := meta.Palette.Colors; len(c) != 1 || c[0].Color != "#010203" || c[0].Weight != 1 {
+			t.Fatalf("Unexpected palette %v", meta.Palette)
+		}
+
+		if meta.Palette.Text != "#FFFFFF" {
+			t.Fatalf("Unexpected text color %q", meta.Palette.Text)
+		}
+
+		if meta.BlurHash != "00FF0080" {
+			t.Fatalf("Unexpected BlurHash %q", meta.BlurHash)
+		}
+
+		if meta.Fields["comment"] != "2019-09-21" {
+			t.Fatalf("Unexpected fields %v", meta.Fields)
+		}
+
+		if meta.Size != int64(len(contents)) {
+			t.Fatalf("Unexpected size %d", meta.Size)
+		}
+
+		if meta.ETag == "" || meta.ETag != res.Header.Get("ETag") {
+			t.Fatalf("Unexpected ETag %q", meta.ETag)
+		}
+	})
+	t.Run("decoded once per source file", func(t *testing.T) {
+		controller := gomock.NewController(t)
+		mockIC := mock_handlers.NewMockimageController(controller)
+
+		decoded := 0
+
+		im := NewImageMetadata(dir, img.StripAll)
+		im.imageControllerCtor = func(context.Context, string) (imageController, error) {
+			decoded++
+			return mockIC, nil
+		}
+
+		mockIC.EXPECT().Dimensions().Return(uint(600), uint(800))
+		mockIC.EXPECT().Format()
+		mockIC.EXPECT().Orientation()
+		mockIC.EXPECT().Palette(gomock.Any())
+		mockIC.EXPECT().Placeholder()
+		mockIC.EXPECT().ExifField(gomock.Any()).AnyTimes()
+		mockIC.EXPECT().Destroy()
+
+		for n := 0; n < 2; n++ {
+			w := httptest.NewRecorder()
+
+			im.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/image.jpg", nil))
+
+			var meta imageMetadata
+
+			if err := json.NewDecoder(w.Result().Body).Decode(&meta); err != nil {
+				t.Fatal(err)
+			}
+
+			if meta.Width != 800 || meta.ETag == "" || meta.ETag != w.Result().Header.Get("ETag") {
+				t.Fatalf("Unexpected metadata %+v", meta)
+			}
+		}
+
+		if decoded != 1 {
+			t.Fatalf("Decoded %d times", decoded)
+		}
+	})
+
+	t.Run("ETag depends on the metadata policy", func(t *testing.T) {
+		path := filepath.Join(dir, "image.jpg")
+
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		strip, err := NewImageMetadata(dir, img.StripAll).etag(path, fi)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keep, err := NewImageMetadata(dir, img.KeepAll).etag(path, fi)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if strip == keep {
+			t.Fatalf("Same ETag %q for both policies", strip)
+		}
+	})
+
+	t.Run("fields follow the metadata policy", func(t *testing.T) {
+		cases := []struct {
+			policy   img.MetadataPolicy
+			expected []string
+		}{
+			{policy: img.StripAll, expected: []string{"exif:FNumber"}},
+			{policy: img.KeepCopyright, expected: []string{"exif:Artist", "exif:FNumber"}},
+			{policy: img.KeepAll, expected: []string{"exif:Artist", "exif:FNumber", "exif:Model"}},
+		}
+
+		for _, c := range cases {
+			controller := gomock.NewController(t)
+			mockIC := mock_handlers.NewMockimageController(controller)
+
+			im := NewImageMetadata(dir, c.policy)
+			im.imageControllerCtor = func(context.Context, string) (imageController, error) {
+				return mockIC, nil
+			}
+
+			mockIC.EXPECT().Dimensions()
+			mockIC.EXPECT().Format()
+			mockIC.EXPECT().Orientation()
+			mockIC.EXPECT().Palette(gomock.Any())
+			mockIC.EXPECT().Placeholder()
+			mockIC.EXPECT().ExifField("exif:Artist").Return("Jane Doe").AnyTimes()
+			mockIC.EXPECT().ExifField("exif:FNumber").Return("28/10")
+			mockIC.EXPECT().ExifField("exif:Model").Return("Camera").AnyTimes()
+			mockIC.EXPECT().ExifField(gomock.Any()).AnyTimes()
+			mockIC.EXPECT().Destroy()
+
+			w := httptest.NewRecorder()
+
+			im.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/image.jpg", nil))
+
+			var meta imageMetadata
+
+			if err := json.NewDecoder(w.Result().Body).Decode(&meta); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(meta.Fields) != len(c.expected) {
+				t.Fatalf("%v: expected %v, got %v", c.policy, c.expected, meta.Fields)
+			}
+
+			for _, name := range c.expected {
+				if meta.Fields[name] == "" {
+					t.Fatalf("%v: expected %v, got %v", c.policy, c.expected, meta.Fields)
+				}
+			}
+
+			controller.Finish()
+		}
+	})
+}
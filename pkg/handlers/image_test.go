@@ -3,25 +3,35 @@
 package handlers
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/golang/mock/gomock"
 
 	"git.quba.fr/qbarrand/quba.fr-server/pkg/handlers/mock_handlers"
+	img "git.quba.fr/qbarrand/quba.fr-server/pkg/image"
 )
 
 func TestImage(t *testing.T) {
-	if NewImage("", 0) == nil {
+	if NewImage("", ImageOptions{}) == nil {
 		t.Fatal("Should not return nil")
 	}
 }
 
 func TestImage_ServeHTTP(t *testing.T) {
-	checkContentLength := func(t *testing.T, res *http.Response) {
-		if res.Header.Get("Content-Length") == "" {
-			t.Fatal("Content-Length undefined")
+	// Images are streamed as they are encoded, so their length is unknown
+	checkStreamed := func(t *testing.T, res *http.Response) {
+		if cl := res.Header.Get("Content-Length"); cl != "" {
+			t.Fatalf("Content-Length should not be set, got %q", cl)
 		}
 	}
 
@@ -37,7 +47,7 @@ func TestImage_ServeHTTP(t *testing.T) {
 		req := httptest.NewRequest(http.MethodGet, "/non-existent-file.jpg", nil)
 		w := httptest.NewRecorder()
 
-		NewImage("testdata", 80).ServeHTTP(w, req)
+		NewImage("testdata", ImageOptions{Quality: 80}).ServeHTTP(w, req)
 
 		res := w.Result()
 
@@ -52,7 +62,7 @@ func TestImage_ServeHTTP(t *testing.T) {
 
 		w := httptest.NewRecorder()
 
-		NewImage("testdata", 80).ServeHTTP(w, req)
+		NewImage("testdata", ImageOptions{Quality: 80}).ServeHTTP(w, req)
 
 		res := w.Result()
 
@@ -70,18 +80,16 @@ func TestImage_ServeHTTP(t *testing.T) {
 		c := gomock.NewController(t)
 		m := mock_handlers.NewMockimageController(c)
 
-		i := NewImage("testdata", 80)
-		i.imageControllerCtor = func(string) (imageController, error) {
+		i := NewImage("testdata", ImageOptions{Quality: 80})
+		i.imageControllerCtor = func(context.Context, string) (imageController, error) {
 			return m, nil
 		}
 
 		gomock.InOrder(
+			m.EXPECT().StripMetadata(img.StripAll),
 			m.EXPECT().SetQuality(uint(80)),
 			m.EXPECT().Convert("webp"),
-			m.EXPECT().MainColor(),
-			m.EXPECT().Bytes(),
-			m.EXPECT().ExifField("comment"),
-			m.EXPECT().ExifField("Iptc4xmpCore:Location"),
+			m.EXPECT().WriteTo(gomock.Any()),
 			m.EXPECT().Destroy(),
 		)
 
@@ -93,8 +101,58 @@ func TestImage_ServeHTTP(t *testing.T) {
 			t.Fatalf("Got HTTP %d", res.StatusCode)
 		}
 
-		checkContentLength(t, res)
+		checkStreamed(t, res)
 		checkContentType(t, res, "image/webp")
+
+		if mc := res.Header.Get("X-Main-Color"); mc != "" {
+			t.Fatalf("X-Main-Color should not be sent unless requested, got %q", mc)
+		}
+	})
+
+	t.Run("explicit format", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/gopher_biplane.jpg?format=webp", nil)
+		req.Header.Set("Accept", "image/jpeg")
+
+		w := httptest.NewRecorder()
+
+		c := gomock.NewController(t)
+		m := mock_handlers.NewMockimageController(c)
+
+		i := NewImage("testdata", ImageOptions{Quality: 80})
+		i.imageControllerCtor = func(context.Context, string) (imageController, error) {
+			return m, nil
+		}
+
+		gomock.InOrder(
+			m.EXPECT().StripMetadata(img.StripAll),
+			m.EXPECT().SetQuality(uint(80)),
+			m.EXPECT().Convert("webp"),
+			m.EXPECT().WriteTo(gomock.Any()),
+			m.EXPECT().Destroy(),
+		)
+
+		i.ServeHTTP(w, req)
+
+		res := w.Result()
+
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("Got HTTP %d", res.StatusCode)
+		}
+
+		checkContentType(t, res, "image/webp")
+	})
+
+	t.Run("unsupported format: HTTP 400", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/gopher_biplane.jpg?format=avif", nil)
+		req.Header.Set("Accept", "image/jpeg")
+
+		w := httptest.NewRecorder()
+
+		NewImage("testdata", ImageOptions{Quality: 80}).ServeHTTP(w, req)
+
+		if res := w.Result(); res.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Got HTTP %d", res.StatusCode)
+		}
 	})
 
 	t.Run("Resize to 1920w and Accept: image/webp", func(t *testing.T) {
@@ -114,19 +172,17 @@ func TestImage_ServeHTTP(t *testing.T) {
 		controller := gomock.NewController(t)
 		mockIC := mock_handlers.NewMockimageController(controller)
 
-		i := NewImage("testdata", quality)
-		i.imageControllerCtor = func(string) (imageController, error) {
+		i := NewImage("testdata", ImageOptions{Quality: quality})
+		i.imageControllerCtor = func(context.Context, string) (imageController, error) {
 			return mockIC, nil
 		}
 
 		gomock.InOrder(
+			mockIC.EXPECT().StripMetadata(img.StripAll),
 			mockIC.EXPECT().Resize(uint(0), uint(width)),
 			mockIC.EXPECT().SetQuality(uint(quality)),
 			mockIC.EXPECT().Convert("webp"),
-			mockIC.EXPECT().MainColor().Return(uint(0), uint(0), uint(0), nil),
-			mockIC.EXPECT().Bytes(),
-			mockIC.EXPECT().ExifField("comment"),
-			mockIC.EXPECT().ExifField("Iptc4xmpCore:Location"),
+			mockIC.EXPECT().WriteTo(gomock.Any()),
 			mockIC.EXPECT().Destroy(),
 		)
 
@@ -138,10 +194,54 @@ func TestImage_ServeHTTP(t *testing.T) {
 			t.Fatalf("Got HTTP %d", res.StatusCode)
 		}
 
-		checkContentLength(t, res)
+		checkStreamed(t, res)
 		checkContentType(t, res, "image/webp")
 	})
 
+	t.Run("client gone while resizing", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		req := httptest.NewRequest(http.MethodGet, "/gopher_biplane.jpg?width=1920", nil).WithContext(ctx)
+		req.Header.Set("Accept", "image/webp")
+
+		w := httptest.NewRecorder()
+
+		controller := gomock.NewController(t)
+		mockIC := mock_handlers.NewMockimageController(controller)
+
+		i := NewImage("testdata", ImageOptions{Quality: 80})
+		i.imageControllerCtor = func(c context.Context, _ string) (imageController, error) {
+			if c != ctx {
+				t.Fatal("The request context should be passed to the image controller")
+			}
+
+			return mockIC, nil
+		}
+
+		before := imageMetrics.Get("cancelled")
+
+		// Nothing is converted nor written once the resize is aborted
+		gomock.InOrder(
+			mockIC.EXPECT().StripMetadata(img.StripAll),
+			mockIC.EXPECT().Resize(uint(0), uint(1920)).DoAndReturn(func(uint, uint) error {
+				cancel()
+				return context.Canceled
+			}),
+			mockIC.EXPECT().Destroy(),
+		)
+
+		i.ServeHTTP(w, req)
+
+		if res := w.Result(); res.Header.Get("Content-Type") != "" {
+			t.Fatal("Nothing should be sent to a client that went away")
+		}
+
+		if after := imageMetrics.Get("cancelled"); after == nil || (before != nil && after.String() == before.String()) {
+			t.Fatalf("The cancellation should be counted, got %v", after)
+		}
+	})
+
 	t.Run("Resize to 1920w and Accept: image/jpeg", func(t *testing.T) {
 		req := httptest.NewRequest(
 			http.MethodGet,
@@ -159,19 +259,57 @@ func TestImage_ServeHTTP(t *testing.T) {
 		controller := gomock.NewController(t)
 		mockIC := mock_handlers.NewMockimageController(controller)
 
-		i := NewImage("testdata", quality)
-		i.imageControllerCtor = func(string) (imageController, error) {
+		i := NewImage("testdata", ImageOptions{Quality: quality})
+		i.imageControllerCtor = func(context.Context, string) (imageController, error) {
 			return mockIC, nil
 		}
 
 		gomock.InOrder(
+			mockIC.EXPECT().StripMetadata(img.StripAll),
 			mockIC.EXPECT().Resize(uint(0), uint(width)),
 			mockIC.EXPECT().SetQuality(uint(quality)),
 			mockIC.EXPECT().Convert("jpg"),
-			mockIC.EXPECT().MainColor().Return(uint(0), uint(0), uint(0), nil),
-			mockIC.EXPECT().Bytes(),
-			mockIC.EXPECT().ExifField("comment"),
-			mockIC.EXPECT().ExifField("Iptc4xmpCore:Location"),
+			mockIC.EXPECT().WriteTo(gomock.Any()),
+			mockIC.EXPECT().Destroy(),
+		)
+
+		i.ServeHTTP(w, req)
+
+		res := w.Result()
+
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("Got HTTP %d", res.StatusCode)
+		}
+
+		checkStreamed(t, res)
+		checkContentType(t, res, "image/jpeg")
+	})
+
+	t.Run("Convert to sRGB and keep the profile", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/gopher_biplane.jpg", nil)
+		req.Header.Set("Accept", "image/jpeg")
+
+		w := httptest.NewRecorder()
+
+		controller := gomock.NewController(t)
+		mockIC := mock_handlers.NewMockimageController(controller)
+
+		opts := ImageOptions{
+			Colors:   img.ColorOptions{ConvertToSRGB: true, KeepProfile: true},
+			Metadata: img.KeepAll,
+			Quality:  80,
+		}
+
+		i := NewImage("testdata", opts)
+		i.imageControllerCtor = func(context.Context, string) (imageController, error) {
+			return mockIC, nil
+		}
+
+		gomock.InOrder(
+			mockIC.EXPECT().ConvertToSRGB(true),
+			mockIC.EXPECT().SetQuality(uint(80)),
+			mockIC.EXPECT().Convert("jpg"),
+			mockIC.EXPECT().WriteTo(gomock.Any()),
 			mockIC.EXPECT().Destroy(),
 		)
 
@@ -183,9 +321,426 @@ func TestImage_ServeHTTP(t *testing.T) {
 			t.Fatalf("Got HTTP %d", res.StatusCode)
 		}
 
-		checkContentLength(t, res)
 		checkContentType(t, res, "image/jpeg")
 	})
+
+	t.Run("Keep the copyright and expose the date", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/gopher_biplane.jpg?meta=1", nil)
+		req.Header.Set("Accept", "image/jpeg")
+
+		w := httptest.NewRecorder()
+
+		controller := gomock.NewController(t)
+		mockIC := mock_handlers.NewMockimageController(controller)
+
+		i := NewImage("testdata", ImageOptions{Metadata: img.KeepCopyright, Quality: 80})
+		i.imageControllerCtor = func(context.Context, string) (imageController, error) {
+			return mockIC, nil
+		}
+
+		const (
+			blurHash = "00FF0080"
+			date     = "2019-09-21"
+			location = "Paris"
+		)
+
+		gomock.InOrder(
+			mockIC.EXPECT().ExifField("comment").Return(date),
+			mockIC.EXPECT().ExifField("Iptc4xmpCore:Location").Return(location),
+			mockIC.EXPECT().Palette(uint(paletteSize)).Return(img.Palette{
+				Colors: []img.PaletteColor{
+					{Color: img.Color{R: 255}, Weight: 0.75},
+					{Color: img.Color{B: 255}, Weight: 0.25},
+				},
+			}, nil),
+			mockIC.EXPECT().Placeholder().Return(img.Placeholder{BlurHash: blurHash}, nil),
+			mockIC.EXPECT().StripMetadata(img.KeepCopyright),
+			mockIC.EXPECT().SetQuality(uint(80)),
+			mockIC.EXPECT().Convert("jpg"),
+			mockIC.EXPECT().WriteTo(gomock.Any()),
+			mockIC.EXPECT().Destroy(),
+		)
+
+		i.ServeHTTP(w, req)
+
+		res := w.Result()
+
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("Got HTTP %d", res.StatusCode)
+		}
+
+		if got := res.Header.Get("X-Date"); got != date {
+			t.Fatalf("Unexpected X-Date: expected %q, got %q", date, got)
+		}
+
+		if got := res.Header.Get("X-Location"); got != location {
+			t.Fatalf("Unexpected X-Location: expected %q, got %q", location, got)
+		}
+
+		if got := res.Header.Get("X-BlurHash"); got != blurHash {
+			t.Fatalf("Unexpected X-BlurHash: expected %q, got %q", blurHash, got)
+		}
+
+		if got, expected := res.Header.Get("X-Palette"), "#FF0000;0.75, #0000FF;0.25"; got != expected {
+			t.Fatalf("Unexpected X-Palette: expected %q, got %q", expected, got)
+		}
+
+		if got, expected := res.Header.Get("X-Main-Color"), "#FF0000"; got != expected {
+			t.Fatalf("Unexpected X-Main-Color: expected %q, got %q", expected, got)
+		}
+	})
+
+	t.Run("Prefer: meta is computed once per source file", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "image")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		if err := ioutil.WriteFile(filepath.Join(dir, "image.jpg"), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		controller := gomock.NewController(t)
+		mockIC := mock_handlers.NewMockimageController(controller)
+
+		i := NewImage(dir, ImageOptions{Metadata: img.KeepAll, Quality: 80})
+		i.imageControllerCtor = func(context.Context, string) (imageController, error) {
+			return mockIC, nil
+		}
+
+		mockIC.EXPECT().ExifField("comment").Return("2019-09-21")
+		mockIC.EXPECT().ExifField("Iptc4xmpCore:Location")
+		mockIC.EXPECT().Palette(uint(paletteSize)).Return(img.Palette{
+			Colors: []img.PaletteColor{{Color: img.Color{R: 1, G: 2, B: 3}, Weight: 1}},
+		}, nil)
+		mockIC.EXPECT().Placeholder()
+		mockIC.EXPECT().SetQuality(uint(80)).Times(2)
+		mockIC.EXPECT().Convert("jpg").Times(2)
+		mockIC.EXPECT().WriteTo(gomock.Any()).Times(2)
+		mockIC.EXPECT().Destroy().Times(2)
+
+		for n := 0; n < 2; n++ {
+			req := httptest.NewRequest(http.MethodGet, "/image.jpg", nil)
+			req.Header.Set("Accept", "image/jpeg")
+			req.Header.Set("Prefer", "respond-async, meta")
+
+			w := httptest.NewRecorder()
+
+			i.ServeHTTP(w, req)
+
+			res := w.Result()
+
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("Got HTTP %d", res.StatusCode)
+			}
+
+			if got := res.Header.Get("Preference-Applied"); got != "meta" {
+				t.Fatalf("Unexpected Preference-Applied %q", got)
+			}
+
+			if got := res.Header.Get("X-Main-Color"); got != "#010203" {
+				t.Fatalf("Unexpected X-Main-Color %q", got)
+			}
+
+			if got := res.Header.Get("X-Date"); got != "2019-09-21" {
+				t.Fatalf("Unexpected X-Date %q", got)
+			}
+		}
+	})
+
+	t.Run("metadata failure cached and not sent", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "image")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		if err := ioutil.WriteFile(filepath.Join(dir, "image.jpg"), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		controller := gomock.NewController(t)
+		mockIC := mock_handlers.NewMockimageController(controller)
+
+		i := NewImage(dir, ImageOptions{Metadata: img.KeepAll, Quality: 80})
+		i.imageControllerCtor = func(context.Context, string) (imageController, error) {
+			return mockIC, nil
+		}
+
+		// The palette is not computed again for the second request
+		mockIC.EXPECT().ExifField(gomock.Any()).Times(2)
+		mockIC.EXPECT().Palette(uint(paletteSize)).Return(img.Palette{}, errors.New("random error"))
+		mockIC.EXPECT().SetQuality(uint(80)).Times(2)
+		mockIC.EXPECT().Convert("jpg").Times(2)
+		mockIC.EXPECT().WriteTo(gomock.Any()).Times(2)
+		mockIC.EXPECT().Destroy().Times(2)
+
+		for n := 0; n < 2; n++ {
+			req := httptest.NewRequest(http.MethodGet, "/image.jpg?meta=1", nil)
+			req.Header.Set("Accept", "image/jpeg")
+
+			w := httptest.NewRecorder()
+
+			i.ServeHTTP(w, req)
+
+			res := w.Result()
+
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("Got HTTP %d", res.StatusCode)
+			}
+
+			for _, h := range []string{"X-BlurHash", "X-Main-Color", "X-Palette", "X-Placeholder"} {
+				if _, ok := res.Header[h]; ok {
+					t.Fatalf("%s should not be sent", h)
+				}
+			}
+		}
+	})
+
+	t.Run("meta headers route sharing the metadata with ImageMetadata", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "image")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		if err := ioutil.WriteFile(filepath.Join(dir, "image.jpg"), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		controller := gomock.NewController(t)
+		mockIC := mock_handlers.NewMockimageController(controller)
+
+		ctor := func(context.Context, string) (imageController, error) {
+			return mockIC, nil
+		}
+
+		i := NewImage(dir, ImageOptions{Metadata: img.KeepAll, Quality: 80})
+		i.imageControllerCtor = ctor
+
+		withMeta := i.WithMetaHeaders()
+
+		im := i.Metadata()
+		im.imageControllerCtor = ctor
+
+		// The metadata is computed once for both handlers
+		mockIC.EXPECT().ExifField(gomock.Any()).AnyTimes()
+		mockIC.EXPECT().Palette(uint(paletteSize)).Return(img.Palette{
+			Colors: []img.PaletteColor{{Color: img.Color{R: 255}, Weight: 1}},
+		}, nil)
+		mockIC.EXPECT().Placeholder()
+		mockIC.EXPECT().SetQuality(uint(80))
+		mockIC.EXPECT().Convert("jpg")
+		mockIC.EXPECT().WriteTo(gomock.Any())
+		mockIC.EXPECT().Dimensions()
+		mockIC.EXPECT().Format()
+		mockIC.EXPECT().Orientation()
+		mockIC.EXPECT().Destroy().Times(2)
+
+		req := httptest.NewRequest(http.MethodGet, "/image.jpg", nil)
+		req.Header.Set("Accept", "image/jpeg")
+
+		w := httptest.NewRecorder()
+
+		withMeta.ServeHTTP(w, req)
+
+		res := w.Result()
+
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("Got HTTP %d", res.StatusCode)
+		}
+
+		if got := res.Header.Get("X-Main-Color"); got != "#FF0000" {
+			t.Fatalf("Unexpected X-Main-Color %q", got)
+		}
+
+		if got := res.Header.Get("Vary"); strings.Contains(got, "Prefer") {
+			t.Fatalf("Unexpected Vary %q", got)
+		}
+
+		w = httptest.NewRecorder()
+
+		im.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/image.jpg", nil))
+
+		var meta imageMetadata
+
+		if err := json.NewDecoder(w.Result().Body).Decode(&meta); err != nil {
+			t.Fatal(err)
+		}
+
+		if meta.MainColor != "#FF0000" {
+			t.Fatalf("Unexpected main color %q", meta.MainColor)
+		}
+	})
+
+	t.Run("ETag computed before decoding", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "image")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		if err := ioutil.WriteFile(filepath.Join(dir, "image.jpg"), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		controller := gomock.NewController(t)
+		mockIC := mock_handlers.NewMockimageController(controller)
+
+		i := NewImage(dir, ImageOptions{Metadata: img.KeepAll, Quality: 80})
+		i.imageControllerCtor = func(context.Context, string) (imageController, error) {
+			return mockIC, nil
+		}
+
+		const body = "encoded image"
+
+		gomock.InOrder(
+			mockIC.EXPECT().SetQuality(uint(80)),
+			mockIC.EXPECT().Convert("jpg"),
+			mockIC.EXPECT().WriteTo(gomock.Any()).DoAndReturn(func(w io.Writer) (int64, error) {
+				n, err := io.WriteString(w, body)
+				return int64(n), err
+			}),
+			mockIC.EXPECT().Destroy(),
+		)
+
+		req := httptest.NewRequest(http.MethodGet, "/image.jpg", nil)
+		req.Header.Set("Accept", "image/jpeg")
+
+		w := httptest.NewRecorder()
+
+		i.ServeHTTP(w, req)
+
+		res := w.Result()
+
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("Got HTTP %d", res.StatusCode)
+		}
+
+		if b, _ := ioutil.ReadAll(res.Body); string(b) != body {
+			t.Fatalf("Unexpected body %q", b)
+		}
+
+		etag := res.Header.Get("ETag")
+		if etag == "" {
+			t.Fatal("ETag undefined")
+		}
+
+		// The second request is answered without creating an image controller
+		i.imageControllerCtor = func(context.Context, string) (imageController, error) {
+			t.Fatal("The image should not be decoded")
+			return nil, nil
+		}
+
+		req.Header.Set("If-None-Match", etag)
+
+		w = httptest.NewRecorder()
+
+		i.ServeHTTP(w, req)
+
+		if res := w.Result(); res.StatusCode != http.StatusNotModified {
+			t.Fatalf("Got HTTP %d", res.StatusCode)
+		}
+
+		// Another format yields another ETag
+		if tag, err := i.etag(filepath.Join(dir, "image.jpg"), mustStat(t, filepath.Join(dir, "image.jpg")), Variant{Format: "webp"}); err != nil || tag == etag {
+			t.Fatalf("Expected a different ETag, got %q (%v)", tag, err)
+		}
+	})
+
+	t.Run("SVG placeholder", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "image")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		if err := ioutil.WriteFile(filepath.Join(dir, "image.jpg"), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		controller := gomock.NewController(t)
+		mockIC := mock_handlers.NewMockimageController(controller)
+
+		i := NewImage(dir, ImageOptions{Quality: 80})
+		i.imageControllerCtor = func(context.Context, string) (imageController, error) {
+			return mockIC, nil
+		}
+
+		ph := img.Placeholder{
+			Preview:       "data:image/jpeg;base64,AAAA",
+			PreviewHeight: 12,
+			PreviewWidth:  16,
+		}
+
+		// The placeholder is only computed once
+		gomock.InOrder(
+			mockIC.EXPECT().Placeholder().Return(ph, nil),
+			mockIC.EXPECT().Destroy(),
+		)
+
+		for n := 0; n < 2; n++ {
+			req := httptest.NewRequest(http.MethodGet, "/image.jpg?placeholder=svg", nil)
+			w := httptest.NewRecorder()
+
+			i.ServeHTTP(w, req)
+
+			res := w.Result()
+
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("Got HTTP %d", res.StatusCode)
+			}
+
+			checkContentType(t, res, "image/svg+xml")
+
+			body, err := ioutil.ReadAll(res.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !strings.Contains(string(body), `viewBox="0 0 16 12"`) || !strings.Contains(string(body), ph.Preview) {
+				t.Fatalf("Unexpected SVG %s", body)
+			}
+		}
+	})
+}
+
+func mustStat(t *testing.T, path string) os.FileInfo {
+	t.Helper()
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return fi
+}
+
+func Test_preferMeta(t *testing.T) {
+	cases := map[string]bool{
+		"":                      false,
+		"meta":                  true,
+		"Meta":                  true,
+		"return=minimal, meta":  true,
+		"meta; foo=bar":         true,
+		"metadata":              false,
+		"return=representation": false,
+	}
+
+	for prefer, expected := range cases {
+		t.Run(prefer, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+			if prefer != "" {
+				req.Header.Set("Prefer", prefer)
+			}
+
+			if got := preferMeta(req); got != expected {
+				t.Fatalf("Expected %t, got %t", expected, got)
+			}
+		})
+	}
 }
 
 func Test_getPreferredHeader(t *testing.T) {
@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// gitLastMod reads the date of the last commit that touched each file of a
+// git checkout, without running git. As walking the history is expensive,
+// the dates are cached until HEAD moves.
+type gitLastMod struct {
+	m     sync.Mutex
+	head  plumbing.Hash
+	times map[string]time.Time
+}
+
+// history walks the commits reachable from head and returns the date of the
+// last commit that touched each file below prefix, by path relative to prefix.
+func history(repo *git.Repository, head plumbing.Hash, prefix string) (map[string]time.Time, error) {
+	commits, err := repo.Log(&git.LogOptions{From: head})
+	if err != nil {
+		return nil, err
+	}
+
+	times := make(map[string]time.Time)
+
+	err = commits.ForEach(func(c *object.Commit) error {
+		tree, err := c.Tree()
+		if err != nil {
+			return err
+		}
+
+		// The first commit is compared with an empty tree
+		var parentTree *object.Tree
+
+		if c.NumParents() != 0 {
+			parent, err := c.Parent(0)
+			if err != nil {
+				return err
+			}
+
+			if parentTree, err = parent.Tree(); err != nil {
+				return err
+			}
+		}
+
+		changes, err := object.DiffTree(parentTree, tree)
+		if err != nil {
+			return err
+		}
+
+		when := c.Committer.When
+
+		for _, change := range changes {
+			// Deleted files do not matter
+			name := change.To.Name
+
+			if name == "" || !strings.HasPrefix(name, prefix) {
+				continue
+			}
+
+			rel := strings.TrimPrefix(name, prefix)
+
+			if t, ok := times[rel]; !ok || when.After(t) {
+				times[rel] = when
+			}
+		}
+
+		return nil
+	})
+
+	return times, err
+}
+
+// lastModTimes returns the date of the last commit that touched each file
+// below dir, by path relative to dir with forward slashes. If dir is not in a
+// git checkout, it returns no dates.
+func (g *gitLastMod) lastModTimes(dir string) (map[string]time.Time, error) {
+	repo, err := git.PlainOpenWithOptions(dir, &git.PlainOpenOptions{DetectDotGit: true})
+	if err == git.ErrRepositoryNotExists {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not open the repository: %v", err)
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve HEAD: %v", err)
+	}
+
+	g.m.Lock()
+	defer g.m.Unlock()
+
+	if g.times != nil && g.head == head.Hash() {
+		return g.times, nil
+	}
+
+	wt, err := repo.Worktree()
+	if err != nil {
+		return nil, fmt.Errorf("could not get the worktree: %v", err)
+	}
+
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	rel, err := filepath.Rel(wt.Filesystem.Root(), absDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var prefix string
+
+	if rel != "." {
+		prefix = filepath.ToSlash(rel) + "/"
+	}
+
+	times, err := history(repo, head.Hash(), prefix)
+	if err != nil {
+		return nil, fmt.Errorf("could not walk the history: %v", err)
+	}
+
+	g.head = head.Hash()
+	g.times = times
+
+	return times, nil
+}
@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+func TestGitLastMod(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lastmod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commit := func(t *testing.T, when time.Time, files ...string) {
+		for _, name := range files {
+			path := filepath.Join(dir, name)
+
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := ioutil.WriteFile(path, []byte(when.String()), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := wt.Add(filepath.ToSlash(name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		sig := &object.Signature{Name: "test", Email: "test@example.com", When: when}
+
+		if _, err := wt.Commit("commit", &git.CommitOptions{Author: sig, Committer: sig}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	second := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	commit(t, first, "index.html", "site/index.html", "site/about.html")
+	commit(t, second, "site/about.html")
+
+	g := &gitLastMod{}
+
+	times, err := g.lastModTimes(filepath.Join(dir, "site"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]time.Time{
+		"index.html": first,
+		"about.html": second,
+	}
+
+	if len(times) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, times)
+	}
+
+	for name, when := range expected {
+		if !times[name].Equal(when) {
+			t.Fatalf("%s: expected %v, got %v", name, when, times[name])
+		}
+	}
+
+	t.Run("cached until HEAD moves", func(t *testing.T) {
+		g.times["about.html"] = time.Time{}
+
+		if times, _ := g.lastModTimes(filepath.Join(dir, "site")); !times["about.html"].IsZero() {
+			t.Fatal("The dates should be cached")
+		}
+
+		third := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+		commit(t, third, "site/index.html")
+
+		times, err := g.lastModTimes(filepath.Join(dir, "site"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !times["index.html"].Equal(third) || !times["about.html"].Equal(second) {
+			t.Fatalf("The dates should be refreshed, got %v", times)
+		}
+	})
+
+	t.Run("not a git checkout", func(t *testing.T) {
+		other, err := ioutil.TempDir("", "lastmod")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(other)
+
+		if times, err := (&gitLastMod{}).lastModTimes(other); err != nil || times != nil {
+			t.Fatalf("Expected no dates and no error, got %v, %v", times, err)
+		}
+	})
+}
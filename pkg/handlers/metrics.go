@@ -0,0 +1,25 @@
+package handlers
+
+import (
+	"expvar"
+	"log"
+	"net/http"
+)
+
+// imageMetrics are published with expvar, under "images".
+var imageMetrics = expvar.NewMap("images")
+
+// requestCancelled returns true if the context of r is done, typically because
+// the client went away; in that case, there is nobody to reply to. It records
+// the cancellation in imageMetrics.
+func requestCancelled(r *http.Request) bool {
+	err := r.Context().Err()
+	if err == nil {
+		return false
+	}
+
+	log.Printf("Request for %s cancelled: %v", r.URL.Path, err)
+	imageMetrics.Add("cancelled", 1)
+
+	return true
+}
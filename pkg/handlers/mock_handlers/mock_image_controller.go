@@ -5,7 +5,9 @@
 package mock_handlers
 
 import (
+	img "git.quba.fr/qbarrand/quba.fr-server/pkg/image"
 	gomock "github.com/golang/mock/gomock"
+	io "io"
 	reflect "reflect"
 )
 
@@ -32,32 +34,32 @@ func (m *MockimageController) EXPECT() *MockimageControllerMockRecorder {
 	return m.recorder
 }
 
-// Bytes mocks base method
-func (m *MockimageController) Bytes() []byte {
+// Convert mocks base method
+func (m *MockimageController) Convert(arg0 string) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Bytes")
-	ret0, _ := ret[0].([]byte)
+	ret := m.ctrl.Call(m, "Convert", arg0)
+	ret0, _ := ret[0].(error)
 	return ret0
 }
 
-// Bytes indicates an expected call of Bytes
-func (mr *MockimageControllerMockRecorder) Bytes() *gomock.Call {
+// Convert indicates an expected call of Convert
+func (mr *MockimageControllerMockRecorder) Convert(arg0 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Bytes", reflect.TypeOf((*MockimageController)(nil).Bytes))
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Convert", reflect.TypeOf((*MockimageController)(nil).Convert), arg0)
 }
 
-// Convert mocks base method
-func (m *MockimageController) Convert(arg0 string) error {
+// ConvertToSRGB mocks base method
+func (m *MockimageController) ConvertToSRGB(arg0 bool) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Convert", arg0)
+	ret := m.ctrl.Call(m, "ConvertToSRGB", arg0)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
-// Convert indicates an expected call of Convert
-func (mr *MockimageControllerMockRecorder) Convert(arg0 interface{}) *gomock.Call {
+// ConvertToSRGB indicates an expected call of ConvertToSRGB
+func (mr *MockimageControllerMockRecorder) ConvertToSRGB(arg0 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Convert", reflect.TypeOf((*MockimageController)(nil).Convert), arg0)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ConvertToSRGB", reflect.TypeOf((*MockimageController)(nil).ConvertToSRGB), arg0)
 }
 
 // Destroy mocks base method
@@ -72,6 +74,21 @@ func (mr *MockimageControllerMockRecorder) Destroy() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Destroy", reflect.TypeOf((*MockimageController)(nil).Destroy))
 }
 
+// Dimensions mocks base method
+func (m *MockimageController) Dimensions() (uint, uint) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Dimensions")
+	ret0, _ := ret[0].(uint)
+	ret1, _ := ret[1].(uint)
+	return ret0, ret1
+}
+
+// Dimensions indicates an expected call of Dimensions
+func (mr *MockimageControllerMockRecorder) Dimensions() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Dimensions", reflect.TypeOf((*MockimageController)(nil).Dimensions))
+}
+
 // ExifField mocks base method
 func (m *MockimageController) ExifField(arg0 string) string {
 	m.ctrl.T.Helper()
@@ -117,6 +134,50 @@ func (mr *MockimageControllerMockRecorder) MainColor() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MainColor", reflect.TypeOf((*MockimageController)(nil).MainColor))
 }
 
+// Orientation mocks base method
+func (m *MockimageController) Orientation() uint {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Orientation")
+	ret0, _ := ret[0].(uint)
+	return ret0
+}
+
+// Orientation indicates an expected call of Orientation
+func (mr *MockimageControllerMockRecorder) Orientation() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Orientation", reflect.TypeOf((*MockimageController)(nil).Orientation))
+}
+
+// Palette mocks base method
+func (m *MockimageController) Palette(arg0 uint) (img.Palette, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Palette", arg0)
+	ret0, _ := ret[0].(img.Palette)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Palette indicates an expected call of Palette
+func (mr *MockimageControllerMockRecorder) Palette(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Palette", reflect.TypeOf((*MockimageController)(nil).Palette), arg0)
+}
+
+// Placeholder mocks base method
+func (m *MockimageController) Placeholder() (img.Placeholder, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Placeholder")
+	ret0, _ := ret[0].(img.Placeholder)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Placeholder indicates an expected call of Placeholder
+func (mr *MockimageControllerMockRecorder) Placeholder() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Placeholder", reflect.TypeOf((*MockimageController)(nil).Placeholder))
+}
+
 // Resize mocks base method
 func (m *MockimageController) Resize(arg0, arg1 uint) error {
 	m.ctrl.T.Helper()
@@ -145,16 +206,31 @@ func (mr *MockimageControllerMockRecorder) SetQuality(arg0 interface{}) *gomock.
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetQuality", reflect.TypeOf((*MockimageController)(nil).SetQuality), arg0)
 }
 
-// StripEXIF mocks base method
-func (m *MockimageController) StripEXIF() error {
+// StripMetadata mocks base method
+func (m *MockimageController) StripMetadata(arg0 img.MetadataPolicy) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "StripEXIF")
+	ret := m.ctrl.Call(m, "StripMetadata", arg0)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
-// StripEXIF indicates an expected call of StripEXIF
-func (mr *MockimageControllerMockRecorder) StripEXIF() *gomock.Call {
+// StripMetadata indicates an expected call of StripMetadata
+func (mr *MockimageControllerMockRecorder) StripMetadata(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "StripMetadata", reflect.TypeOf((*MockimageController)(nil).StripMetadata), arg0)
+}
+
+// WriteTo mocks base method
+func (m *MockimageController) WriteTo(arg0 io.Writer) (int64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "WriteTo", arg0)
+	ret0, _ := ret[0].(int64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// WriteTo indicates an expected call of WriteTo
+func (mr *MockimageControllerMockRecorder) WriteTo(arg0 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "StripEXIF", reflect.TypeOf((*MockimageController)(nil).StripEXIF))
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "WriteTo", reflect.TypeOf((*MockimageController)(nil).WriteTo), arg0)
 }
@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"fmt"
+	"strings"
+
+	img "git.quba.fr/qbarrand/quba.fr-server/pkg/image"
+)
+
+const paletteSize = 5
+
+type (
+	paletteColor struct {
+		Color  string  `json:"color"`
+		Weight float64 `json:"weight"`
+	}
+
+	paletteJSON struct {
+		Colors  []paletteColor `json:"colors"`
+		Vibrant string         `json:"vibrant"`
+		Muted   string         `json:"muted"`
+		Text    string         `json:"text"`
+	}
+)
+
+func newPaletteJSON(p img.Palette) paletteJSON {
+	pj := paletteJSON{
+		Colors:  make([]paletteColor, 0, len(p.Colors)),
+		Vibrant: p.Vibrant.String(),
+		Muted:   p.Muted.String(),
+		Text:    p.Text.String(),
+	}
+
+	for _, c := range p.Colors {
+		pj.Colors = append(pj.Colors, paletteColor{Color: c.String(), Weight: c.Weight})
+	}
+
+	return pj
+}
+
+// paletteHeader formats the colors of p for the X-Palette header, e.g.
+// "#1A2B3C;0.52, #4D5E6F;0.48".
+func paletteHeader(p img.Palette) string {
+	colors := make([]string, 0, len(p.Colors))
+
+	for _, c := range p.Colors {
+		colors = append(colors, fmt.Sprintf("%s;%.2f", c.String(), c.Weight))
+	}
+
+	return strings.Join(colors, ", ")
+}
@@ -0,0 +1,278 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	img "git.quba.fr/qbarrand/quba.fr-server/pkg/image"
+)
+
+const defaultPicturePreset = "full"
+
+// picturePreset describes how an image is laid out in a page: the widths it
+// is rendered in, and the sizes attribute telling browsers which one to pick.
+type picturePreset struct {
+	sizes  string
+	widths []uint
+}
+
+var picturePresets = map[string]picturePreset{
+	"full": {
+		sizes:  "100vw",
+		widths: []uint{640, 960, 1280, 1920, 2560},
+	},
+	"half": {
+		sizes:  "(min-width: 768px) 50vw, 100vw",
+		widths: []uint{480, 640, 960, 1280},
+	},
+	"thumbnail": {
+		sizes:  "(min-width: 768px) 25vw, 50vw",
+		widths: []uint{160, 320, 480},
+	},
+}
+
+// pictureFormats are the formats of the <source> elements, by order of
+// preference; the <img> element falls back to JPEG. AVIF is not offered, as
+// ImageMagick 6 cannot encode it.
+var pictureFormats = []string{"webp"}
+
+// altFields are the metadata properties used as alternative text, by order of
+// preference.
+var altFields = []string{
+	"IPTC:2:120",
+	"exif:ImageDescription",
+	"Iptc4xmpCore:Location",
+}
+
+const pictureTemplateStr = `<picture>
+{{- range .Sources }}
+	<source type="{{ .Type }}" srcset="{{ .SrcSet }}" sizes="{{ $.Sizes }}">
+{{- end }}
+	<img src="{{ .Src }}" srcset="{{ .SrcSet }}" sizes="{{ .Sizes }}" width="{{ .Width }}" height="{{ .Height }}" alt="{{ .Alt }}"
+		{{- with .MainColor }} style="background-color: {{ . }}"{{ end }} loading="lazy" decoding="async">
+</picture>
+`
+
+type (
+	// pictureInfo holds the properties of a source image used in snippets.
+	pictureInfo struct {
+		alt       string
+		height    uint
+		mainColor string
+		width     uint
+	}
+
+	pictureSource struct {
+		SrcSet string
+		Type   string
+	}
+
+	pictureData struct {
+		Alt       string
+		Height    uint
+		MainColor string
+		Sizes     string
+		Sources   []pictureSource
+		Src       string
+		SrcSet    string
+		Width     uint
+	}
+
+	picture struct {
+		baseDir             string
+		imageControllerCtor func(context.Context, string) (imageController, error)
+		infos               *sourceCache
+		template            *template.Template
+	}
+)
+
+// Picture returns a handler replying with a <picture> HTML fragment for an
+// image of baseDir, with a srcset in every format for the widths of the preset
+// passed in the preset query parameter.
+func Picture(baseDir string) (http.Handler, error) {
+	t, err := template.New("picture").Parse(pictureTemplateStr)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse the picture template: %v", err)
+	}
+
+	imageProcessorCtor := func(ctx context.Context, path string) (imageController, error) {
+		p, err := img.NewImagickProcessor(ctx, path)
+		if err != nil {
+			return nil, err
+		}
+
+		return imageController(p), nil
+	}
+
+	return &picture{
+		baseDir:             baseDir,
+		imageControllerCtor: imageProcessorCtor,
+		infos:               newSourceCache(),
+		template:            t,
+	}, nil
+}
+
+// info returns the properties of the image at path, from cache if the file
+// did not change.
+func (pic *picture) info(ctx context.Context, path string, fi os.FileInfo) (pictureInfo, error) {
+	v, err := pic.infos.getOrCompute(path, fi, func() (interface{}, error) {
+		p, err := pic.imageControllerCtor(ctx, path)
+		if err != nil {
+			return nil, fmt.Errorf("could not create the image controller: %v", err)
+		}
+		defer p.Destroy()
+
+		var pi pictureInfo
+
+		pi.height, pi.width = p.Dimensions()
+
+		if cr, cg, cb, err := p.MainColor(); err != nil {
+			log.Printf("Could not get the main color of %s: %v", path, err)
+		} else {
+			pi.mainColor = fmt.Sprintf("#%02X%02X%02X", cr, cg, cb)
+		}
+
+		for _, name := range altFields {
+			if pi.alt = strings.TrimSpace(p.ExifField(name)); pi.alt != "" {
+				break
+			}
+		}
+
+		return pi, nil
+	})
+	if err != nil {
+		return pictureInfo{}, err
+	}
+
+	return v.(pictureInfo), nil
+}
+
+// pictureWidths returns the widths of preset narrower than the image, followed
+// by 0 for the image in its original size.
+func pictureWidths(preset picturePreset, width uint) []uint {
+	var widths []uint
+
+	for _, w := range preset.widths {
+		if w < width {
+			widths = append(widths, w)
+		}
+	}
+
+	return append(widths, 0)
+}
+
+// pictureURL returns the URL of the image at path in format, with width if it
+// is not 0.
+func pictureURL(path, format string, width uint) string {
+	q := url.Values{"format": {format}}
+
+	if width != 0 {
+		q.Set("width", strconv.FormatUint(uint64(width), 10))
+	}
+
+	u := url.URL{Path: path, RawQuery: q.Encode()}
+
+	return u.String()
+}
+
+// srcSet returns the srcset attribute of the image at path in format.
+func srcSet(path, format string, widths []uint, originalWidth uint) string {
+	candidates := make([]string, 0, len(widths))
+
+	for _, w := range widths {
+		descriptor := w
+
+		if w == 0 {
+			descriptor = originalWidth
+		}
+
+		candidates = append(candidates, fmt.Sprintf("%s %dw", pictureURL(path, format, w), descriptor))
+	}
+
+	return strings.Join(candidates, ", ")
+}
+
+func (pic *picture) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	presetName := r.FormValue("preset")
+	if presetName == "" {
+		presetName = defaultPicturePreset
+	}
+
+	preset, ok := picturePresets[presetName]
+	if !ok {
+		log.Printf("%q: unknown preset", presetName)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	imagePath := filepath.Join(pic.baseDir, r.URL.Path)
+
+	fi, err := os.Stat(imagePath)
+	if err != nil || fi.IsDir() {
+		log.Printf("%s: not a file: %v", imagePath, err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	pi, err := pic.info(r.Context(), imagePath, fi)
+	if err != nil {
+		if requestCancelled(r) {
+			return
+		}
+
+		log.Printf("Could not read %s: %v", imagePath, err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	widths := pictureWidths(preset, pi.width)
+
+	// The fallback is the largest resized image, if any
+	fallbackWidth := widths[0]
+
+	if len(widths) > 1 {
+		fallbackWidth = widths[len(widths)-2]
+	}
+
+	data := pictureData{
+		Alt:       pi.alt,
+		Height:    pi.height,
+		MainColor: pi.mainColor,
+		Sizes:     preset.sizes,
+		Src:       pictureURL(r.URL.Path, "jpg", fallbackWidth),
+		SrcSet:    srcSet(r.URL.Path, "jpg", widths, pi.width),
+		Width:     pi.width,
+	}
+
+	for _, format := range pictureFormats {
+		data.Sources = append(data.Sources, pictureSource{
+			SrcSet: srcSet(r.URL.Path, format, widths, pi.width),
+			Type:   variantFormats[format],
+		})
+	}
+
+	var buf bytes.Buffer
+
+	if err := pic.template.Execute(&buf, data); err != nil {
+		log.Printf("Could not execute the picture template: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	headers := w.Header()
+	headers.Set("Content-Length", strconv.Itoa(buf.Len()))
+	headers.Set("Content-Type", "text/html; charset=utf-8")
+
+	if _, err := buf.WriteTo(w); err != nil {
+		log.Printf("could not write the reply: %v", err)
+	}
+}
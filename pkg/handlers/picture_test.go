@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+
+	"git.quba.fr/qbarrand/quba.fr-server/pkg/handlers/mock_handlers"
+)
+
+func TestPicture(t *testing.T) {
+	if h, err := Picture(""); err != nil || h == nil {
+		t.Fatalf("Should return a handler, got %v", err)
+	}
+}
+
+func Test_pictureWidths(t *testing.T) {
+	preset := picturePreset{widths: []uint{640, 1280, 1920}}
+
+	cases := map[uint]string{
+		4000: "[640 1280 1920 0]",
+		1280: "[640 0]",
+		500:  "[0]",
+	}
+
+	for width, expected := range cases {
+		if got := fmt.Sprint(pictureWidths(preset, width)); got != expected {
+			t.Fatalf("%d: expected %s, got %s", width, expected, got)
+		}
+	}
+}
+
+func TestPicture_ServeHTTP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "picture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "a b.jpg"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	newPicture := func(t *testing.T) (*picture, *int) {
+		controller := gomock.NewController(t)
+		decoded := 0
+
+		h, err := Picture(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pic := h.(*picture)
+		pic.imageControllerCtor = func(context.Context, string) (imageController, error) {
+			m := mock_handlers.NewMockimageController(controller)
+			m.EXPECT().Dimensions().Return(uint(1000), uint(1500))
+			m.EXPECT().MainColor().Return(uint(16), uint(32), uint(48), nil)
+			m.EXPECT().ExifField("IPTC:2:120").Return("")
+			m.EXPECT().ExifField("exif:ImageDescription").Return(`A "quoted" <description>`)
+			m.EXPECT().Destroy()
+
+			decoded++
+
+			return m, nil
+		}
+
+		return pic, &decoded
+	}
+
+	get := func(t *testing.T, pic *picture, url string) *http.Response {
+		w := httptest.NewRecorder()
+
+		pic.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+
+		return w.Result()
+	}
+
+	t.Run("half preset", func(t *testing.T) {
+		pic, decoded := newPicture(t)
+
+		res := get(t, pic, "/a%20b.jpg?preset=half")
+
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("Got HTTP %d", res.StatusCode)
+		}
+
+		if ct := res.Header.Get("Content-Type"); ct != "text/html; charset=utf-8" {
+			t.Fatalf("Unexpected Content-Type %q", ct)
+		}
+
+		b, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		html := string(b)
+
+		for _, expected := range []string{
+			`<source type="image/webp" srcset="/a%20b.jpg?format=webp&amp;width=480 480w, /a%20b.jpg?format=webp&amp;width=640 640w, /a%20b.jpg?format=webp&amp;width=960 960w, /a%20b.jpg?format=webp&amp;width=1280 1280w, /a%20b.jpg?format=webp 1500w" sizes="(min-width: 768px) 50vw, 100vw">`,
+			`src="/a%20b.jpg?format=jpg&amp;width=1280"`,
+			`width="1500" height="1000"`,
+			`alt="A &#34;quoted&#34; &lt;description&gt;"`,
+			`style="background-color: #102030"`,
+		} {
+			if !strings.Contains(html, expected) {
+				t.Fatalf("%q not found in:\n%s", expected, html)
+			}
+		}
+
+		// The properties of the image are cached
+		if res := get(t, pic, "/a%20b.jpg"); res.StatusCode != http.StatusOK {
+			t.Fatalf("Got HTTP %d", res.StatusCode)
+		}
+
+		if *decoded != 1 {
+			t.Fatalf("Expected the image to be decoded once, got %d", *decoded)
+		}
+	})
+
+	t.Run("unknown preset: HTTP 400", func(t *testing.T) {
+		pic, _ := newPicture(t)
+
+		if res := get(t, pic, "/a%20b.jpg?preset=huge"); res.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Got HTTP %d", res.StatusCode)
+		}
+	})
+
+	t.Run("non-existing file: HTTP 404", func(t *testing.T) {
+		pic, _ := newPicture(t)
+
+		if res := get(t, pic, "/missing.jpg"); res.StatusCode != http.StatusNotFound {
+			t.Fatalf("Got HTTP %d", res.StatusCode)
+		}
+	})
+}
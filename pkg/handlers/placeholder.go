@@ -0,0 +1,35 @@
+package handlers
+
+import (
+	"fmt"
+	"os"
+
+	img "git.quba.fr/qbarrand/quba.fr-server/pkg/image"
+)
+
+// cachedPlaceholder returns the placeholder of the image at path from cache,
+// or computes it with p.
+func cachedPlaceholder(cache *sourceCache, path string, fi os.FileInfo, p imageController) (img.Placeholder, error) {
+	v, err := cache.getOrCompute(path, fi, func() (interface{}, error) {
+		return p.Placeholder()
+	})
+	if err != nil {
+		return img.Placeholder{}, err
+	}
+
+	return v.(img.Placeholder), nil
+}
+
+// placeholderSVG renders ph as a blurred SVG image. The SVG has no intrinsic
+// size and scales to its container, keeping the aspect ratio of the image.
+func placeholderSVG(ph img.Placeholder) []byte {
+	const svgTemplate = `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %[1]d %[2]d">` +
+		`<filter id="b" color-interpolation-filters="sRGB">` +
+		`<feGaussianBlur stdDeviation="1"/>` +
+		`<feComponentTransfer><feFuncA type="discrete" tableValues="1 1"/></feComponentTransfer>` +
+		`</filter>` +
+		`<image width="%[1]d" height="%[2]d" preserveAspectRatio="none" filter="url(#b)" href="%[3]s"/>` +
+		`</svg>`
+
+	return []byte(fmt.Sprintf(svgTemplate, ph.PreviewWidth, ph.PreviewHeight, ph.Preview))
+}
@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// RobotsGroup is a group of robots.txt rules applying to some user agents.
+type RobotsGroup struct {
+	UserAgents []string `json:"user_agents"`
+	Allow      []string `json:"allow,omitempty"`
+	Disallow   []string `json:"disallow,omitempty"`
+
+	// CrawlDelay is the number of seconds between two requests; unset if 0.
+	CrawlDelay uint `json:"crawl_delay,omitempty"`
+}
+
+// RobotsOptions configures the Robots handler.
+type RobotsOptions struct {
+	// BaseURL is the URL at which the served directory is published. The
+	// sitemap is advertised at BaseURL/sitemap.xml.
+	BaseURL string
+
+	// DisallowAll forbids crawling anything, e.g. outside of production.
+	// Groups are then ignored.
+	DisallowAll bool
+
+	// Groups are the rules for each user agent. If empty, everything may be
+	// crawled.
+	Groups []RobotsGroup
+}
+
+// ReadRobotsGroups reads a JSON array of groups from the file at path.
+func ReadRobotsGroups(path string) ([]RobotsGroup, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []RobotsGroup
+
+	if err := json.Unmarshal(b, &groups); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %v", path, err)
+	}
+
+	for i, g := range groups {
+		if len(g.UserAgents) == 0 {
+			return nil, fmt.Errorf("group %d: no user agent", i)
+		}
+
+		for _, ua := range g.UserAgents {
+			if ua == "" || strings.ContainsAny(ua, "\r\n") {
+				return nil, fmt.Errorf("group %d: invalid user agent %q", i, ua)
+			}
+		}
+
+		for _, p := range append(append([]string{}, g.Allow...), g.Disallow...) {
+			if !strings.HasPrefix(p, "/") && !strings.HasPrefix(p, "*") || strings.ContainsAny(p, "\r\n") {
+				return nil, fmt.Errorf("group %d: invalid path %q", i, p)
+			}
+		}
+	}
+
+	return groups, nil
+}
+
+type robots struct {
+	content []byte
+}
+
+// Robots returns a handler serving robots.txt.
+func Robots(opts RobotsOptions) http.Handler {
+	var b bytes.Buffer
+
+	switch {
+	case opts.DisallowAll:
+		b.WriteString("User-agent: *\nDisallow: /\n")
+	case len(opts.Groups) == 0:
+		b.WriteString("User-agent: *\nDisallow:\n")
+	default:
+		for i, g := range opts.Groups {
+			if i != 0 {
+				b.WriteByte('\n')
+			}
+
+			for _, ua := range g.UserAgents {
+				fmt.Fprintf(&b, "User-agent: %s\n", ua)
+			}
+
+			for _, p := range g.Allow {
+				fmt.Fprintf(&b, "Allow: %s\n", p)
+			}
+
+			for _, p := range g.Disallow {
+				fmt.Fprintf(&b, "Disallow: %s\n", p)
+			}
+
+			// A group needs at least one rule
+			if len(g.Allow) == 0 && len(g.Disallow) == 0 {
+				b.WriteString("Disallow:\n")
+			}
+
+			if g.CrawlDelay != 0 {
+				fmt.Fprintf(&b, "Crawl-delay: %d\n", g.CrawlDelay)
+			}
+		}
+	}
+
+	// Nothing to discover if crawling is forbidden
+	if !opts.DisallowAll && opts.BaseURL != "" {
+		fmt.Fprintf(&b, "\nSitemap: %s/%s\n", strings.TrimSuffix(opts.BaseURL, "/"), sitemapName)
+	}
+
+	return &robots{content: b.Bytes()}
+}
+
+func (rb *robots) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	if _, err := w.Write(rb.content); err != nil {
+		log.Printf("Could not write robots.txt to the reply: %v", err)
+	}
+}
@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadRobotsGroups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "robots")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(t *testing.T, contents string) string {
+		path := filepath.Join(dir, "robots.json")
+
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		return path
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		groups, err := ReadRobotsGroups(write(t, `[{"user_agents": ["*"], "disallow": ["/drafts/"], "crawl_delay": 10}]`))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(groups) != 1 || groups[0].UserAgents[0] != "*" || groups[0].Disallow[0] != "/drafts/" || groups[0].CrawlDelay != 10 {
+			t.Fatalf("Unexpected groups %+v", groups)
+		}
+	})
+
+	for name, contents := range map[string]string{
+		"no user agent":   `[{"disallow": ["/"]}]`,
+		"relative path":   `[{"user_agents": ["*"], "allow": ["drafts/"]}]`,
+		"newline in path": `[{"user_agents": ["*"], "disallow": ["/a\nSitemap: x"]}]`,
+		"invalid JSON":    `{`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ReadRobotsGroups(write(t, contents)); err == nil {
+				t.Fatal("Expected an error")
+			}
+		})
+	}
+}
+
+func TestRobots_ServeHTTP(t *testing.T) {
+	cases := map[string]struct {
+		opts     RobotsOptions
+		expected string
+	}{
+		"default": {
+			opts: RobotsOptions{BaseURL: "https://example.com/"},
+			expected: `User-agent: *
+Disallow:
+
+Sitemap: https://example.com/sitemap.xml
+`,
+		},
+		"groups": {
+			opts: RobotsOptions{
+				BaseURL: "https://example.com",
+				Groups: []RobotsGroup{
+					{UserAgents: []string{"*"}, Allow: []string{"/drafts/public.html"}, Disallow: []string{"/drafts/"}},
+					{UserAgents: []string{"BadBot", "OtherBot"}, CrawlDelay: 30},
+				},
+			},
+			expected: `User-agent: *
+Allow: /drafts/public.html
+Disallow: /drafts/
+
+User-agent: BadBot
+User-agent: OtherBot
+Disallow:
+Crawl-delay: 30
+
+Sitemap: https://example.com/sitemap.xml
+`,
+		},
+		"disallow all": {
+			opts: RobotsOptions{
+				BaseURL:     "https://staging.example.com",
+				DisallowAll: true,
+				Groups:      []RobotsGroup{{UserAgents: []string{"*"}}},
+			},
+			expected: `User-agent: *
+Disallow: /
+`,
+		},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+
+			Robots(c.opts).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/robots.txt", nil))
+
+			res := w.Result()
+
+			if ct := res.Header.Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+				t.Fatalf("Unexpected Content-Type %q", ct)
+			}
+
+			b, err := ioutil.ReadAll(res.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(b) != c.expected {
+				t.Fatalf("Unexpected robots.txt:\n%s", b)
+			}
+		})
+	}
+}
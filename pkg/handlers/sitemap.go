@@ -1,59 +1,600 @@
 package handlers
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"encoding/xml"
 	"fmt"
+	"hash/fnv"
+	"io/ioutil"
 	"log"
 	"net/http"
-	"os/exec"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"text/template"
+	"time"
 )
 
-type sitemap struct {
-	dir      string
-	template *template.Template
+// sitemapChangeFreqs are the valid values of <changefreq>.
+var sitemapChangeFreqs = map[string]bool{
+	"always":  true,
+	"hourly":  true,
+	"daily":   true,
+	"weekly":  true,
+	"monthly": true,
+	"yearly":  true,
+	"never":   true,
 }
 
-func Sitemap(dir string) (http.Handler, error) {
-	const sitemapTemplateStr = `<?xml version="1.0" encoding="UTF-8"?>
-<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+// pageExtensions are the extensions of the files listed as pages.
+var pageExtensions = map[string]bool{
+	".htm":  true,
+	".html": true,
+}
+
+// SitemapRule sets the change frequency and priority of the files matching
+// Pattern. See matchPattern for the pattern syntax.
+type SitemapRule struct {
+	Pattern    string `json:"pattern"`
+	ChangeFreq string `json:"changefreq,omitempty"`
+	Priority   string `json:"priority,omitempty"`
+}
+
+// SitemapOptions configures the Sitemap handler.
+type SitemapOptions struct {
+	// BaseURL is prepended to the path of each file, e.g. https://quba.fr.
+	BaseURL string
+
+	// Images lists the images of each page with the image sitemap
+	// extension.
+	Images bool
+
+	// Include restricts the sitemap to the files matching one of the
+	// patterns, if any. Files matching one of the Exclude patterns are left
+	// out.
+	Include []string
+	Exclude []string
+
+	// Rules are applied to each page; the first matching rule wins.
+	Rules []SitemapRule
+}
+
+// ReadSitemapRules reads a JSON array of rules from the file at path.
+func ReadSitemapRules(path string) ([]SitemapRule, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []SitemapRule
+
+	if err := json.Unmarshal(b, &rules); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %v", path, err)
+	}
+
+	for _, r := range rules {
+		if r.ChangeFreq != "" && !sitemapChangeFreqs[r.ChangeFreq] {
+			return nil, fmt.Errorf("%q: invalid changefreq %q", r.Pattern, r.ChangeFreq)
+		}
+
+		if r.Priority != "" {
+			if p, err := strconv.ParseFloat(r.Priority, 64); err != nil || p < 0 || p > 1 {
+				return nil, fmt.Errorf("%q: the priority should be between 0 and 1, got %q", r.Pattern, r.Priority)
+			}
+		}
+	}
+
+	return rules, nil
+}
+
+// matchPattern returns true if pattern matches rel, a path relative to the
+// served directory with forward slashes. Patterns ending with a slash match
+// everything in a directory, e.g. drafts/; patterns without a slash match the
+// file name, e.g. *.pdf; other patterns match the whole path, e.g.
+// album/*.html.
+func matchPattern(pattern, rel string) bool {
+	switch {
+	case strings.HasSuffix(pattern, "/"):
+		return strings.HasPrefix(rel, pattern)
+	case !strings.Contains(pattern, "/"):
+		ok, _ := path.Match(pattern, path.Base(rel))
+		return ok
+	default:
+		ok, _ := path.Match(pattern, rel)
+		return ok
+	}
+}
+
+func matchAny(patterns []string, rel string) bool {
+	for _, p := range patterns {
+		if matchPattern(p, rel) {
+			return true
+		}
+	}
+
+	return false
+}
+
+const (
+	// Limits of a single sitemap file, from the sitemap protocol
+	maxSitemapBytes = 50 << 20
+	maxSitemapURLs  = 50000
+
+	// sitemapRescanInterval is the minimum time between two walks of the
+	// served directory for changes.
+	sitemapRescanInterval = 10 * time.Second
+
+	sitemapIndexName = "sitemap_index.xml"
+	sitemapName      = "sitemap.xml"
+)
+
+const sitemapTemplateStr = `
+{{- define "urlset" -}}
+<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9"
+	{{- if . }} xmlns:image="http://www.google.com/schemas/sitemap-image/1.1"{{ end }}>
+{{- end }}
+
+{{- define "url" }}
 	<url>
-		<loc>https://quba.fr/</loc>
+		<loc>{{ xml .Loc }}</loc>
 		<lastmod>{{ .LastMod }}</lastmod>
-		<changefreq>monthly</changefreq>
-		<priority>1.0</priority>
+		{{- with .ChangeFreq }}
+		<changefreq>{{ . }}</changefreq>
+		{{- end }}
+		{{- with .Priority }}
+		<priority>{{ . }}</priority>
+		{{- end }}
+		{{- range .Images }}
+		<image:image>
+			<image:loc>{{ xml . }}</image:loc>
+		</image:image>
+		{{- end }}
 	</url>
-</urlset>`
+{{- end }}
+
+{{- define "index" -}}
+<?xml version="1.0" encoding="UTF-8"?>
+<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+{{- range . }}
+	<sitemap>
+		<loc>{{ xml .Loc }}</loc>
+		<lastmod>{{ .LastMod }}</lastmod>
+	</sitemap>
+{{- end }}
+</sitemapindex>
+{{ end }}`
+
+const sitemapURLSetEnd = "\n</urlset>\n"
+
+type (
+	sitemapURL struct {
+		Loc        string
+		LastMod    string
+		ChangeFreq string
+		Priority   string
+		Images     []string
+
+		modTime time.Time
+	}
+
+	// sitemapFile is a rendered sitemap file.
+	sitemapFile struct {
+		content []byte
+
+		// modTime is the newest lastmod of the entries of the file.
+		modTime time.Time
 
-	template, err := template.New("sitemap").Parse(sitemapTemplateStr)
+		// etag is a hash of the content, and changed is when it last
+		// changed; unlike modTime, they also change when an entry is
+		// removed or its changefreq or priority changes.
+		changed time.Time
+		etag    string
+	}
+
+	// sitemapFiles are the rendered sitemap files, by name. They are valid
+	// as long as the hash of the entries they were rendered from does not
+	// change.
+	sitemapFiles struct {
+		files   map[string]sitemapFile
+		hash    uint64
+		scanned time.Time
+	}
+
+	sitemap struct {
+		dir      string
+		opts     SitemapOptions
+		template *template.Template
+
+		// lastModTimes returns the last modification time of the files
+		// below a directory, by relative path. Files it does not know
+		// about, e.g. outside of a git checkout, fall back to their mtime.
+		lastModTimes func(string) (map[string]time.Time, error)
+
+		// maxBytes and maxURLs are the limits of a single sitemap file
+		maxBytes int
+		maxURLs  int
+
+		// rescanInterval is the minimum time between two walks of dir.
+		rescanInterval time.Duration
+
+		cache sitemapFiles
+		m     sync.Mutex
+	}
+)
+
+// Sitemap returns a handler serving the sitemap of the pages in dir. If there
+// are too many pages for a single file, they are split in several files,
+// sitemap-1.xml, sitemap-2.xml and so on, listed in sitemap_index.xml; in that
+// case, sitemap.xml serves the index. Every file is also available gzipped,
+// with a .gz suffix.
+func Sitemap(dir string, opts SitemapOptions) (http.Handler, error) {
+	funcs := template.FuncMap{
+		"xml": func(s string) (string, error) {
+			var b strings.Builder
+			err := xml.EscapeText(&b, []byte(s))
+			return b.String(), err
+		},
+	}
+
+	template, err := template.New("sitemap").Funcs(funcs).Parse(sitemapTemplateStr)
 	if err != nil {
 		return nil, fmt.Errorf("could not parse the sitemap template: %v", err)
 	}
 
-	h := sitemap{
-		dir:      dir,
-		template: template,
+	opts.BaseURL = strings.TrimSuffix(opts.BaseURL, "/")
+
+	h := &sitemap{
+		dir:            dir,
+		lastModTimes:   (&gitLastMod{}).lastModTimes,
+		maxBytes:       maxSitemapBytes,
+		maxURLs:        maxSitemapURLs,
+		opts:           opts,
+		rescanInterval: sitemapRescanInterval,
+		template:       template,
 	}
 
 	return h, err
 }
 
-func (s sitemap) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	cmd := exec.Command("git", "log", "-1", "--format=%ad", "--date=iso-strict")
-	cmd.Dir = s.dir
+// loc returns the URL of the file at rel. Index pages are linked to through
+// their directory.
+func (s *sitemap) loc(rel string) string {
+	if path.Base(rel) == "index.html" {
+		rel = strings.TrimSuffix(rel, "index.html")
+	}
+
+	u := url.URL{Path: "/" + rel}
+
+	return s.opts.BaseURL + u.EscapedPath()
+}
+
+// urls walks the served directory and returns the sitemap entries, sorted by
+// location.
+func (s *sitemap) urls() ([]sitemapURL, error) {
+	times, err := s.lastModTimes(s.dir)
+	if err != nil {
+		log.Printf("Falling back to modification times: %v", err)
+	}
+
+	var (
+		pages  = make(map[string]*sitemapURL)
+		images = make(map[string][]string)
+	)
+
+	err = filepath.Walk(s.dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(s.dir, p)
+		if err != nil {
+			return err
+		}
+
+		rel = filepath.ToSlash(rel)
+
+		if fi.IsDir() {
+			// Skip hidden directories such as .git
+			if (p != s.dir && strings.HasPrefix(fi.Name(), ".")) || matchAny(s.opts.Exclude, rel+"/") {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if (len(s.opts.Include) != 0 && !matchAny(s.opts.Include, rel)) || matchAny(s.opts.Exclude, rel) {
+			return nil
+		}
+
+		ext := strings.ToLower(path.Ext(rel))
+
+		if s.opts.Images && imageExtensions[ext] {
+			images[path.Dir(rel)] = append(images[path.Dir(rel)], s.loc(rel))
+			return nil
+		}
 
-	out, err := cmd.Output()
+		if !pageExtensions[ext] {
+			return nil
+		}
+
+		lastMod, ok := times[rel]
+		if !ok {
+			lastMod = fi.ModTime()
+		}
+
+		u := &sitemapURL{
+			Loc:     s.loc(rel),
+			LastMod: lastMod.UTC().Format(time.RFC3339),
+			modTime: lastMod,
+		}
+
+		for _, r := range s.opts.Rules {
+			if matchPattern(r.Pattern, rel) {
+				u.ChangeFreq = r.ChangeFreq
+				u.Priority = r.Priority
+				break
+			}
+		}
+
+		pages[rel] = u
+
+		return nil
+	})
 	if err != nil {
-		log.Printf("Error while running git: %v", err)
+		return nil, err
+	}
+
+	// Images belong to the index page of their directory, or of the closest
+	// parent directory that has one.
+	for dir, locs := range images {
+		for d := dir; ; d = path.Dir(d) {
+			index := path.Join(d, "index.html")
+
+			if page, ok := pages[index]; ok {
+				page.Images = append(page.Images, locs...)
+				break
+			}
+
+			if d == "." {
+				break
+			}
+		}
+	}
+
+	urls := make([]sitemapURL, 0, len(pages))
+
+	for _, u := range pages {
+		sort.Strings(u.Images)
+		urls = append(urls, *u)
+	}
+
+	sort.Slice(urls, func(i, j int) bool {
+		return urls[i].Loc < urls[j].Loc
+	})
+
+	return urls, nil
+}
+
+// hashURLs returns a hash of urls, which changes whenever the rendered
+// sitemap would.
+func hashURLs(urls []sitemapURL) uint64 {
+	h := fnv.New64a()
+
+	for _, u := range urls {
+		fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s\x00%s\x00", u.Loc, u.LastMod, u.ChangeFreq, u.Priority, strings.Join(u.Images, "\x00"))
+	}
+
+	return h.Sum64()
+}
+
+// split renders urls in as many <urlset> documents as needed to stay within
+// the limits of a sitemap file.
+func (s *sitemap) split(urls []sitemapURL) ([]sitemapFile, error) {
+	var start bytes.Buffer
+
+	if err := s.template.ExecuteTemplate(&start, "urlset", s.opts.Images); err != nil {
+		return nil, err
+	}
+
+	var (
+		files []sitemapFile
+		cur   = sitemapFile{content: append([]byte(nil), start.Bytes()...)}
+		count int
+		entry bytes.Buffer
+	)
+
+	for _, u := range urls {
+		entry.Reset()
+
+		if err := s.template.ExecuteTemplate(&entry, "url", u); err != nil {
+			return nil, err
+		}
+
+		if count != 0 && (count == s.maxURLs || len(cur.content)+entry.Len()+len(sitemapURLSetEnd) > s.maxBytes) {
+			cur.content = append(cur.content, sitemapURLSetEnd...)
+			files = append(files, cur)
+
+			cur = sitemapFile{content: append([]byte(nil), start.Bytes()...)}
+			count = 0
+		}
+
+		cur.content = append(cur.content, entry.Bytes()...)
+		count++
+
+		if u.modTime.After(cur.modTime) {
+			cur.modTime = u.modTime
+		}
+	}
+
+	cur.content = append(cur.content, sitemapURLSetEnd...)
+
+	return append(files, cur), nil
+}
+
+// render returns the sitemap files for urls, by name.
+func (s *sitemap) render(urls []sitemapURL) (map[string]sitemapFile, error) {
+	parts, err := s.split(urls)
+	if err != nil {
+		return nil, err
+	}
+
+	type indexEntry struct {
+		Loc     string
+		LastMod string
+	}
+
+	var (
+		entries = make([]indexEntry, 0, len(parts))
+		files   = make(map[string]sitemapFile)
+		index   = sitemapFile{}
+	)
+
+	for n, part := range parts {
+		name := fmt.Sprintf("sitemap-%d.xml", n+1)
+
+		files[name] = part
+
+		entries = append(entries, indexEntry{
+			Loc:     s.opts.BaseURL + "/" + name,
+			LastMod: part.modTime.UTC().Format(time.RFC3339),
+		})
+
+		if part.modTime.After(index.modTime) {
+			index.modTime = part.modTime
+		}
+	}
+
+	var b bytes.Buffer
+
+	if err := s.template.ExecuteTemplate(&b, "index", entries); err != nil {
+		return nil, err
+	}
+
+	index.content = b.Bytes()
+	files[sitemapIndexName] = index
+
+	if len(parts) == 1 {
+		files[sitemapName] = parts[0]
+	} else {
+		files[sitemapName] = index
+	}
+
+	// Adding entries to files while ranging over it could compress them again
+	compressed := make(map[string]sitemapFile, len(files))
+
+	for name, f := range files {
+		var gz bytes.Buffer
+
+		zw, err := gzip.NewWriterLevel(&gz, gzip.BestCompression)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := zw.Write(f.content); err != nil {
+			return nil, err
+		}
+
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+
+		compressed[name+".gz"] = sitemapFile{content: gz.Bytes(), modTime: f.modTime}
+	}
+
+	for name, f := range compressed {
+		files[name] = f
+	}
+
+	return files, nil
+}
+
+// files returns the rendered sitemap files, from cache if the pages did not
+// change. dir is walked for changes at most every rescanInterval.
+func (s *sitemap) files() (map[string]sitemapFile, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.cache.files != nil && time.Since(s.cache.scanned) < s.rescanInterval {
+		return s.cache.files, nil
+	}
+
+	urls, err := s.urls()
+	if err != nil {
+		return nil, fmt.Errorf("could not list the pages: %v", err)
+	}
+
+	now := time.Now()
+	hash := hashURLs(urls)
+
+	if s.cache.files != nil && s.cache.hash == hash {
+		s.cache.scanned = now
+		return s.cache.files, nil
+	}
+
+	files, err := s.render(urls)
+	if err != nil {
+		return nil, fmt.Errorf("could not render the sitemap: %v", err)
+	}
+
+	for name, f := range files {
+		if f.etag, err = hashBytes(f.content); err != nil {
+			return nil, fmt.Errorf("could not hash %s: %v", name, err)
+		}
+
+		f.etag = `"` + f.etag + `"`
+		f.changed = now
+
+		if old, ok := s.cache.files[name]; ok {
+			// Last-Modified has a resolution of a second
+			if old.etag == f.etag {
+				f.changed = old.changed
+			} else if next := old.changed.Add(time.Second); f.changed.Before(next) {
+				f.changed = next
+			}
+		}
+
+		files[name] = f
+	}
+
+	s.cache = sitemapFiles{files: files, hash: hash, scanned: now}
+
+	return files, nil
+}
+
+func (s *sitemap) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	files, err := s.files()
+	if err != nil {
+		log.Print(err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	date := strings.TrimSuffix(string(out), "\n")
+	name := path.Base(r.URL.Path)
 
-	w.Header().Set("Content-Type", "application/xml")
+	f, ok := files[name]
+	if !ok {
+		log.Printf("%s: no such sitemap", name)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
 
-	if err := s.template.Execute(w, struct{ LastMod string }{date}); err != nil {
-		log.Printf("could not render the template to the reply: %v", err)
+	if strings.HasSuffix(name, ".gz") {
+		w.Header().Set("Content-Type", "application/gzip")
+	} else {
+		w.Header().Set("Content-Type", "application/xml")
 	}
+
+	// Handles If-None-Match, and If-Modified-Since against the last change
+	// of the content, which the newest lastmod does not reflect.
+	w.Header().Set("ETag", f.etag)
+
+	http.ServeContent(w, r, name, f.changed, bytes.NewReader(f.content))
 }
@@ -1,9 +1,21 @@
 package handlers
 
-import "testing"
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
 
 func TestSitemap(t *testing.T) {
-	s, err := Sitemap("/random/path")
+	s, err := Sitemap("/random/path", SitemapOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -12,3 +24,353 @@ func TestSitemap(t *testing.T) {
 		t.Fatal("Should not be nil")
 	}
 }
+
+func Test_matchPattern(t *testing.T) {
+	cases := []struct {
+		pattern string
+		rel     string
+		match   bool
+	}{
+		{pattern: "drafts/", rel: "drafts/a.html", match: true},
+		{pattern: "drafts/", rel: "album/drafts/a.html"},
+		{pattern: "*.html", rel: "album/a.html", match: true},
+		{pattern: "*.html", rel: "album/a.htm"},
+		{pattern: "album/*.html", rel: "album/a.html", match: true},
+		{pattern: "album/*.html", rel: "album/sub/a.html"},
+	}
+
+	for _, c := range cases {
+		if got := matchPattern(c.pattern, c.rel); got != c.match {
+			t.Fatalf("%q on %q: expected %t, got %t", c.pattern, c.rel, c.match, got)
+		}
+	}
+}
+
+func TestReadSitemapRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sitemap-rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(t *testing.T, contents string) string {
+		path := filepath.Join(dir, "rules.json")
+
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		return path
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		rules, err := ReadSitemapRules(write(t, `[{"pattern": "index.html", "changefreq": "weekly", "priority": "1.0"}]`))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(rules) != 1 || rules[0] != (SitemapRule{Pattern: "index.html", ChangeFreq: "weekly", Priority: "1.0"}) {
+			t.Fatalf("Unexpected rules %+v", rules)
+		}
+	})
+
+	for name, contents := range map[string]string{
+		"invalid changefreq": `[{"pattern": "*", "changefreq": "sometimes"}]`,
+		"invalid priority":   `[{"pattern": "*", "priority": "2"}]`,
+		"invalid JSON":       `{`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ReadSitemapRules(write(t, contents)); err == nil {
+				t.Fatal("Expected an error")
+			}
+		})
+	}
+}
+
+func TestSitemap_ServeHTTP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sitemap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := []string{
+		"index.html",
+		"about.html",
+		"album/index.html",
+		"album/photo 1.jpg",
+		"album/sub/photo2.jpg",
+		"drafts/index.html",
+		"notes.txt",
+		".git/index.html",
+	}
+
+	for _, name := range files {
+		path := filepath.Join(dir, name)
+
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mtime := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	if err := os.Chtimes(filepath.Join(dir, "about.html"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := Sitemap(dir, SitemapOptions{
+		BaseURL: "https://example.com/",
+		Exclude: []string{"drafts/"},
+		Images:  true,
+		Rules: []SitemapRule{
+			{Pattern: "index.html", ChangeFreq: "weekly", Priority: "1.0"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := h.(*sitemap)
+	s.lastModTimes = func(string) (map[string]time.Time, error) {
+		return map[string]time.Time{
+			"index.html":       time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC),
+			"album/index.html": time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC),
+		}, nil
+	}
+
+	w := httptest.NewRecorder()
+
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/sitemap.xml", nil))
+
+	res := w.Result()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Got HTTP %d", res.StatusCode)
+	}
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9" xmlns:image="http://www.google.com/schemas/sitemap-image/1.1">
+	<url>
+		<loc>https://example.com/</loc>
+		<lastmod>2021-01-02T03:04:05Z</lastmod>
+		<changefreq>weekly</changefreq>
+		<priority>1.0</priority>
+	</url>
+	<url>
+		<loc>https://example.com/about.html</loc>
+		<lastmod>2020-03-01T12:00:00Z</lastmod>
+	</url>
+	<url>
+		<loc>https://example.com/album/</loc>
+		<lastmod>2021-06-01T00:00:00Z</lastmod>
+		<changefreq>weekly</changefreq>
+		<priority>1.0</priority>
+		<image:image>
+			<image:loc>https://example.com/album/photo%201.jpg</image:loc>
+		</image:image>
+		<image:image>
+			<image:loc>https://example.com/album/sub/photo2.jpg</image:loc>
+		</image:image>
+	</url>
+</urlset>
+`
+
+	if got := string(b); got != expected {
+		t.Fatalf("Unexpected sitemap:\n%s", strings.TrimSpace(got))
+	}
+}
+
+func TestSitemap_ServeHTTP_index(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sitemap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i := 0; i < 5; i++ {
+		if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("page%d.html", i)), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h, err := Sitemap(dir, SitemapOptions{BaseURL: "https://example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newest := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	s := h.(*sitemap)
+	s.maxURLs = 2
+	s.lastModTimes = func(string) (map[string]time.Time, error) {
+		times := make(map[string]time.Time)
+
+		for i := 0; i < 5; i++ {
+			times[fmt.Sprintf("page%d.html", i)] = newest.AddDate(0, 0, -i)
+		}
+
+		return times, nil
+	}
+
+	get := func(t *testing.T, url string, header http.Header) *http.Response {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, url, nil)
+
+		for k, v := range header {
+			r.Header[k] = v
+		}
+
+		s.ServeHTTP(w, r)
+
+		return w.Result()
+	}
+
+	read := func(t *testing.T, res *http.Response) string {
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("Got HTTP %d", res.StatusCode)
+		}
+
+		b, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return string(b)
+	}
+
+	expectedIndex := `<?xml version="1.0" encoding="UTF-8"?>
+<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+	<sitemap>
+		<loc>https://example.com/sitemap-1.xml</loc>
+		<lastmod>2021-06-01T00:00:00Z</lastmod>
+	</sitemap>
+	<sitemap>
+		<loc>https://example.com/sitemap-2.xml</loc>
+		<lastmod>2021-05-30T00:00:00Z</lastmod>
+	</sitemap>
+	<sitemap>
+		<loc>https://example.com/sitemap-3.xml</loc>
+		<lastmod>2021-05-28T00:00:00Z</lastmod>
+	</sitemap>
+</sitemapindex>
+`
+
+	t.Run("index", func(t *testing.T) {
+		for _, url := range []string{"/sitemap_index.xml", "/sitemap.xml"} {
+			if got := read(t, get(t, url, nil)); got != expectedIndex {
+				t.Fatalf("%s: unexpected index:\n%s", url, got)
+			}
+		}
+	})
+
+	t.Run("part", func(t *testing.T) {
+		got := read(t, get(t, "/sitemap-3.xml", nil))
+
+		if strings.Count(got, "<url>") != 1 || !strings.Contains(got, "<loc>https://example.com/page4.html</loc>") {
+			t.Fatalf("Unexpected part:\n%s", got)
+		}
+	})
+
+	t.Run("gzip", func(t *testing.T) {
+		res := get(t, "/sitemap_index.xml.gz", nil)
+
+		if ct := res.Header.Get("Content-Type"); ct != "application/gzip" {
+			t.Fatalf("Unexpected Content-Type %q", ct)
+		}
+
+		zr, err := gzip.NewReader(bytes.NewReader([]byte(read(t, res))))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := ioutil.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(b) != expectedIndex {
+			t.Fatalf("Unexpected index:\n%s", b)
+		}
+	})
+
+	t.Run("each file compressed once", func(t *testing.T) {
+		files, err := s.files()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The index, sitemap.xml and 3 parts, plain and gzipped
+		if len(files) != 10 {
+			t.Fatalf("Expected 10 files, got %d", len(files))
+		}
+
+		for name := range files {
+			if strings.HasSuffix(name, ".gz.gz") {
+				t.Fatalf("%s: compressed twice", name)
+			}
+
+			if !strings.HasSuffix(name, ".gz") {
+				if _, ok := files[name+".gz"]; !ok {
+					t.Fatalf("%s: not compressed", name)
+				}
+			}
+		}
+	})
+
+	t.Run("not modified", func(t *testing.T) {
+		res := get(t, "/sitemap.xml", nil)
+
+		etag, lastModified := res.Header.Get("ETag"), res.Header.Get("Last-Modified")
+
+		if etag == "" || lastModified == "" {
+			t.Fatalf("Unexpected headers %v", res.Header)
+		}
+
+		for _, header := range []http.Header{{"If-None-Match": {etag}}, {"If-Modified-Since": {lastModified}}} {
+			if res := get(t, "/sitemap.xml", header); res.StatusCode != http.StatusNotModified {
+				t.Fatalf("%v: got HTTP %d", header, res.StatusCode)
+			}
+		}
+	})
+
+	t.Run("modified when a page is removed", func(t *testing.T) {
+		res := get(t, "/sitemap-1.xml", nil)
+
+		etag, lastModified := res.Header.Get("ETag"), res.Header.Get("Last-Modified")
+
+		// page0, the newest, is still in the first part
+		if err := os.Remove(filepath.Join(dir, "page1.html")); err != nil {
+			t.Fatal(err)
+		}
+
+		// Not seen until the directory is walked again
+		if res := get(t, "/sitemap-1.xml", http.Header{"If-None-Match": {etag}}); res.StatusCode != http.StatusNotModified {
+			t.Fatalf("Got HTTP %d", res.StatusCode)
+		}
+
+		s.rescanInterval = 0
+
+		// The newest lastmod of the part did not change, but its content did
+		for _, header := range []http.Header{{"If-None-Match": {etag}}, {"If-Modified-Since": {lastModified}}} {
+			if res := get(t, "/sitemap-1.xml", header); res.StatusCode != http.StatusOK {
+				t.Fatalf("%v: got HTTP %d", header, res.StatusCode)
+			}
+		}
+	})
+
+	t.Run("unknown part: HTTP 404", func(t *testing.T) {
+		if res := get(t, "/sitemap-4.xml", nil); res.StatusCode != http.StatusNotFound {
+			t.Fatalf("Got HTTP %d", res.StatusCode)
+		}
+	})
+}
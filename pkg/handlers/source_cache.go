@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+type (
+	sourceCacheEntry struct {
+		modTime time.Time
+		size    int64
+		value   interface{}
+	}
+
+	// sourceCache caches values derived from source files. An entry stays
+	// valid as long as its file keeps the same size and modification time.
+	sourceCache struct {
+		entries map[string]sourceCacheEntry
+		m       sync.Mutex
+	}
+)
+
+func newSourceCache() *sourceCache {
+	return &sourceCache{entries: make(map[string]sourceCacheEntry)}
+}
+
+// get returns the value cached for path. fi describes the current state of
+// the file; if it is nil, nothing is ever found.
+func (sc *sourceCache) get(path string, fi os.FileInfo) (interface{}, bool) {
+	if fi == nil {
+		return nil, false
+	}
+
+	sc.m.Lock()
+	defer sc.m.Unlock()
+
+	e, ok := sc.entries[path]
+	if !ok || e.size != fi.Size() || !e.modTime.Equal(fi.ModTime()) {
+		return nil, false
+	}
+
+	return e.value, true
+}
+
+// set caches v for path. If fi is nil, nothing is cached.
+func (sc *sourceCache) set(path string, fi os.FileInfo, v interface{}) {
+	if fi == nil {
+		return
+	}
+
+	sc.m.Lock()
+	defer sc.m.Unlock()
+
+	sc.entries[path] = sourceCacheEntry{
+		modTime: fi.ModTime(),
+		size:    fi.Size(),
+		value:   v,
+	}
+}
+
+// getOrCompute returns the value cached for path, or computes and caches it.
+func (sc *sourceCache) getOrCompute(path string, fi os.FileInfo, compute func() (interface{}, error)) (interface{}, error) {
+	if v, ok := sc.get(path, fi); ok {
+		return v, nil
+	}
+
+	v, err := compute()
+	if err != nil {
+		return nil, err
+	}
+
+	sc.set(path, fi, v)
+
+	return v, nil
+}
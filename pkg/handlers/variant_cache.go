@@ -0,0 +1,277 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tempPrefix starts the names of the variants being written.
+const tempPrefix = ".tmp-"
+
+// variantCache stores rendered images on disk, named after their ETag. As the
+// ETag changes whenever the source file or the rendering options change, stale
+// variants are never served; they are pruned, least recently used first, once
+// the cache outgrows its maximum size.
+type variantCache struct {
+	dir string
+
+	// maxBytes is the maximum size of the cache; 0 means unlimited.
+	maxBytes int64
+
+	// size is the size of the cache, or -1 if it has not been measured
+	// yet; variants committed by other processes are only accounted for
+	// on the next prune.
+	size int64
+
+	// writers are the variants being written, which close discards.
+	closed  bool
+	writers map[*variantWriter]struct{}
+
+	m sync.Mutex
+}
+
+// newVariantCache returns a cache storing up to maxBytes of variants in dir,
+// or nil if dir is empty.
+func newVariantCache(dir string, maxBytes int64) *variantCache {
+	if dir == "" {
+		return nil
+	}
+
+	return &variantCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		size:     -1,
+		writers:  make(map[*variantWriter]struct{}),
+	}
+}
+
+func (vc *variantCache) path(etag string) string {
+	return filepath.Join(vc.dir, etag)
+}
+
+// has returns true if the variant with etag is cached.
+func (vc *variantCache) has(etag string) bool {
+	_, err := os.Stat(vc.path(etag))
+
+	return err == nil
+}
+
+// open returns the cached variant with etag, and marks it as recently used.
+func (vc *variantCache) open(etag string) (*os.File, error) {
+	f, err := os.Open(vc.path(etag))
+	if err != nil {
+		return nil, err
+	}
+
+	if vc.maxBytes > 0 {
+		now := time.Now()
+
+		if err := os.Chtimes(f.Name(), now, now); err != nil {
+			log.Printf("Could not mark %s as used: %v", f.Name(), err)
+		}
+	}
+
+	return f, nil
+}
+
+// added accounts for a variant of n bytes, and prunes the cache if it became
+// too large.
+func (vc *variantCache) added(n int64) {
+	if vc.maxBytes <= 0 {
+		return
+	}
+
+	vc.m.Lock()
+	defer vc.m.Unlock()
+
+	if vc.size >= 0 {
+		vc.size += n
+
+		if vc.size <= vc.maxBytes {
+			return
+		}
+	}
+
+	size, err := vc.prune()
+	if err != nil {
+		log.Printf("Could not prune the cache: %v", err)
+	}
+
+	vc.size = size
+}
+
+// prune removes the least recently used variants until the cache fits in
+// maxBytes, and returns its size.
+func (vc *variantCache) prune() (int64, error) {
+	fis, err := ioutil.ReadDir(vc.dir)
+	if err != nil {
+		return -1, err
+	}
+
+	var size int64
+
+	variants := fis[:0]
+
+	for _, fi := range fis {
+		if !fi.Mode().IsRegular() || strings.HasPrefix(fi.Name(), tempPrefix) {
+			continue
+		}
+
+		size += fi.Size()
+		variants = append(variants, fi)
+	}
+
+	sort.Slice(variants, func(i, j int) bool {
+		return variants[i].ModTime().Before(variants[j].ModTime())
+	})
+
+	removed := 0
+
+	for _, fi := range variants {
+		if size <= vc.maxBytes {
+			break
+		}
+
+		if err := os.Remove(filepath.Join(vc.dir, fi.Name())); err != nil && !os.IsNotExist(err) {
+			return size, err
+		}
+
+		size -= fi.Size()
+		removed++
+	}
+
+	if removed != 0 {
+		log.Printf("Pruned %d variants from the cache, down to %d bytes", removed, size)
+	}
+
+	return size, nil
+}
+
+// variantWriter writes a variant to a temporary file, which only becomes
+// visible in the cache once committed, so that partial renders are never
+// served.
+type variantWriter struct {
+	*os.File
+
+	cache *variantCache
+	path  string
+
+	// err is the first error met by the writer returned by tee.
+	err error
+}
+
+// create returns a writer for the variant with etag.
+func (vc *variantCache) create(etag string) (*variantWriter, error) {
+	vc.m.Lock()
+	defer vc.m.Unlock()
+
+	if vc.closed {
+		return nil, errors.New("the cache is closed")
+	}
+
+	if err := os.MkdirAll(vc.dir, 0755); err != nil {
+		return nil, fmt.Errorf("could not create the cache directory: %v", err)
+	}
+
+	f, err := ioutil.TempFile(vc.dir, tempPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	vw := &variantWriter{File: f, cache: vc, path: vc.path(etag)}
+	vc.writers[vw] = struct{}{}
+
+	return vw, nil
+}
+
+// done forgets vw, which was committed or aborted.
+func (vc *variantCache) done(vw *variantWriter) {
+	vc.m.Lock()
+	defer vc.m.Unlock()
+
+	delete(vc.writers, vw)
+}
+
+// close discards the variants still being written, and makes create fail from
+// then on. It is called on shutdown once no request is being served, so that
+// no temporary file outlives the process.
+func (vc *variantCache) close() {
+	vc.m.Lock()
+	defer vc.m.Unlock()
+
+	vc.closed = true
+
+	for vw := range vc.writers {
+		vw.discard()
+		delete(vc.writers, vw)
+	}
+}
+
+// teeWriter writes to w, and to the variant on a best-effort basis.
+type teeWriter struct {
+	w  io.Writer
+	vw *variantWriter
+}
+
+func (t teeWriter) Write(b []byte) (int, error) {
+	if t.vw.err == nil {
+		if _, err := t.vw.Write(b); err != nil {
+			t.vw.err = err
+		}
+	}
+
+	return t.w.Write(b)
+}
+
+// tee returns a writer writing to w and to the variant. Failing to write the
+// variant, e.g. because the disk is full, does not interrupt w; the variant is
+// then not committed.
+func (vw *variantWriter) tee(w io.Writer) io.Writer {
+	return teeWriter{w: w, vw: vw}
+}
+
+// commit makes the variant available in the cache.
+func (vw *variantWriter) commit() error {
+	defer vw.cache.done(vw)
+
+	if vw.err != nil {
+		return vw.err
+	}
+
+	fi, err := vw.Stat()
+	if err != nil {
+		return err
+	}
+
+	if err := vw.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(vw.Name(), vw.path); err != nil {
+		return err
+	}
+
+	vw.cache.added(fi.Size())
+
+	return nil
+}
+
+// abort discards the variant if it was not committed.
+func (vw *variantWriter) abort() {
+	vw.cache.done(vw)
+	vw.discard()
+}
+
+func (vw *variantWriter) discard() {
+	vw.Close()
+	os.Remove(vw.Name())
+}
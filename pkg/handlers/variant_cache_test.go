@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_variantWriter_tee(t *testing.T) {
+	dir, err := ioutil.TempDir("", "variants")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	vc := newVariantCache(dir, 0)
+
+	t.Run("cached", func(t *testing.T) {
+		vw, err := vc.create("ok")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer vw.abort()
+
+		var reply bytes.Buffer
+
+		if _, err := vw.tee(&reply).Write([]byte("image")); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := vw.commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		if b, err := ioutil.ReadFile(vc.path("ok")); err != nil || string(b) != "image" || reply.String() != "image" {
+			t.Fatalf("Unexpected cached %q (%v) and reply %q", b, err, reply.String())
+		}
+	})
+
+	t.Run("cache failure", func(t *testing.T) {
+		vw, err := vc.create("failed")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer vw.abort()
+
+		// Writing to the variant fails, like on a full disk
+		vw.File.Close()
+
+		var reply bytes.Buffer
+
+		out := vw.tee(&reply)
+
+		for _, s := range []string{"ima", "ge"} {
+			if _, err := out.Write([]byte(s)); err != nil {
+				t.Fatalf("The reply was interrupted: %v", err)
+			}
+		}
+
+		if reply.String() != "image" {
+			t.Fatalf("Unexpected reply %q", reply.String())
+		}
+
+		if err := vw.commit(); err == nil {
+			t.Fatal("A failed variant should not be committed")
+		}
+
+		if vc.has("failed") {
+			t.Fatal("The failed variant is cached")
+		}
+	})
+}
+
+func Test_variantCache_prune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "variants")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	vc := newVariantCache(dir, 10)
+
+	now := time.Now()
+
+	// Three 4-byte variants, from the least recently used
+	for n, etag := range []string{"a", "b", "c"} {
+		if err := ioutil.WriteFile(vc.path(etag), []byte("1234"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		when := now.Add(time.Duration(n-10) * time.Minute)
+
+		if err := os.Chtimes(vc.path(etag), when, when); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Using a makes b the least recently used
+	f, err := vc.open("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// Not accounted for, and not removed
+	if err := ioutil.WriteFile(filepath.Join(dir, tempPrefix+"x"), []byte("1234"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	vw, err := vc.create("d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vw.abort()
+
+	if _, err := vw.Write([]byte("1234")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vw.commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	for etag, expected := range map[string]bool{"a": true, "b": false, "c": false, "d": true} {
+		if vc.has(etag) != expected {
+			t.Fatalf("%s: expected cached to be %t", etag, expected)
+		}
+	}
+
+	if vc.size != 8 {
+		t.Fatalf("Expected a size of 8 bytes, got %d", vc.size)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, tempPrefix+"x")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_variantCache_close(t *testing.T) {
+	dir, err := ioutil.TempDir("", "variants")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	vc := newVariantCache(dir, 0)
+
+	committed, err := vc.create("committed")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := committed.commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Left behind, e.g. by a render that outlived the drain timeout
+	if _, err := vc.create("pending"); err != nil {
+		t.Fatal(err)
+	}
+
+	vc.close()
+
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fis) != 1 || fis[0].Name() != "committed" {
+		t.Fatalf("Only the committed variant should be left, got %d files", len(fis))
+	}
+
+	if _, err := vc.create("late"); err == nil {
+		t.Fatal("A closed cache should not accept variants")
+	}
+}
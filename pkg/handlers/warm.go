@@ -0,0 +1,243 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ParseVariant parses a variant from an output format and a size. The size is
+// either "original", or a width or a height in pixels suffixed with w or h,
+// e.g. 1920w.
+func ParseVariant(format, size string) (Variant, error) {
+	if _, ok := variantFormats[format]; !ok {
+		return Variant{}, fmt.Errorf("%q: unsupported format", format)
+	}
+
+	v := Variant{Format: format}
+
+	if size == "original" {
+		return v, nil
+	}
+
+	if len(size) < 2 {
+		return Variant{}, fmt.Errorf("%q: invalid size", size)
+	}
+
+	n, err := strconv.ParseUint(size[:len(size)-1], 10, 64)
+	if err != nil || n == 0 {
+		return Variant{}, fmt.Errorf("%q: invalid size", size)
+	}
+
+	switch size[len(size)-1] {
+	case 'h':
+		v.Height = uint(n)
+	case 'w':
+		v.Width = uint(n)
+	default:
+		return Variant{}, fmt.Errorf("%q: the size should end with h or w", size)
+	}
+
+	return v, nil
+}
+
+// String returns the variant in the form accepted by ParseVariant, e.g.
+// webp:1920w.
+func (v Variant) String() string {
+	var size string
+
+	switch {
+	case v.Width != 0:
+		size = strconv.FormatUint(uint64(v.Width), 10) + "w"
+	case v.Height != 0:
+		size = strconv.FormatUint(uint64(v.Height), 10) + "h"
+	default:
+		size = "original"
+	}
+
+	return v.Format + ":" + size
+}
+
+// WarmProgress reports the rendering of a variant by Image.Warm.
+type WarmProgress struct {
+	// Done is the number of variants processed so far, out of Total.
+	Done  int
+	Total int
+
+	Path    string
+	Variant Variant
+
+	// Cached is true if the variant was already in the cache.
+	Cached bool
+
+	Err error
+}
+
+// warmVariant renders v of the image at path into the variant cache, unless
+// it is already cached. It returns true in that case.
+func (i Image) warmVariant(ctx context.Context, path string, v Variant) (bool, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+
+	hash, err := i.etag(path, fi, v)
+	if err != nil {
+		return false, fmt.Errorf("could not compute the ETag: %v", err)
+	}
+
+	if i.variants.has(hash) {
+		return true, nil
+	}
+
+	p, err := i.imageControllerCtor(ctx, path)
+	if err != nil {
+		return false, fmt.Errorf("could not create the image controller: %v", err)
+	}
+	defer p.Destroy()
+
+	if err := i.render(p, v); err != nil {
+		return false, err
+	}
+
+	vw, err := i.variants.create(hash)
+	if err != nil {
+		return false, fmt.Errorf("could not create the cache file: %v", err)
+	}
+	defer vw.abort()
+
+	if _, err := p.WriteTo(vw); err != nil {
+		return false, fmt.Errorf("could not encode the image: %v", err)
+	}
+
+	return false, vw.commit()
+}
+
+// Warm renders variants of every image below the base directory into the
+// variant cache, so that they are served without delay. It runs at most
+// concurrency renders at a time, and calls progress, if not nil, once per
+// variant from a single goroutine. It returns the number of variants that
+// could not be rendered, and stops early if ctx is done.
+func (i Image) Warm(ctx context.Context, variants []Variant, concurrency int, progress func(WarmProgress)) (int, error) {
+	if i.variants == nil {
+		return 0, errors.New("no cache directory is configured")
+	}
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	paths, _, _, err := scanImages(i.baseDir)
+	if err != nil {
+		return 0, fmt.Errorf("could not list the images in %s: %v", i.baseDir, err)
+	}
+
+	type job struct {
+		path    string
+		variant Variant
+	}
+
+	var (
+		jobs    = make(chan job)
+		results = make(chan WarmProgress)
+		wg      sync.WaitGroup
+	)
+
+	go func() {
+		defer close(jobs)
+
+		for _, path := range paths {
+			for _, v := range variants {
+				select {
+				case jobs <- job{path: path, variant: v}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	for n := 0; n < concurrency; n++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for j := range jobs {
+				cached, err := i.warmVariant(ctx, j.path, j.variant)
+
+				results <- WarmProgress{
+					Path:    j.path,
+					Variant: j.variant,
+					Cached:  cached,
+					Err:     err,
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var (
+		done   int
+		failed int
+		total  = len(paths) * len(variants)
+	)
+
+	for res := range results {
+		done++
+
+		res.Done = done
+		res.Total = total
+
+		if res.Err != nil {
+			failed++
+		}
+
+		if progress != nil {
+			progress(res)
+		}
+	}
+
+	return failed, ctx.Err()
+}
+
+// ParseVariants returns a variant for every combination of formats and sizes,
+// followed by presets, which are format:size pairs such as webp:1920w.
+func ParseVariants(formats, sizes, presets []string) ([]Variant, error) {
+	var variants []Variant
+
+	for _, format := range formats {
+		for _, size := range sizes {
+			v, err := ParseVariant(format, size)
+			if err != nil {
+				return nil, err
+			}
+
+			variants = append(variants, v)
+		}
+	}
+
+	for _, preset := range presets {
+		parts := strings.SplitN(preset, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%q: presets should be in the format:size form", preset)
+		}
+
+		v, err := ParseVariant(parts[0], parts[1])
+		if err != nil {
+			return nil, err
+		}
+
+		variants = append(variants, v)
+	}
+
+	return variants, nil
+}
@@ -0,0 +1,245 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+
+	"git.quba.fr/qbarrand/quba.fr-server/pkg/handlers/mock_handlers"
+	img "git.quba.fr/qbarrand/quba.fr-server/pkg/image"
+)
+
+func TestParseVariant(t *testing.T) {
+	cases := []struct {
+		format   string
+		size     string
+		expected Variant
+		err      bool
+	}{
+		{format: "webp", size: "original", expected: Variant{Format: "webp"}},
+		{format: "jpg", size: "1920w", expected: Variant{Format: "jpg", Width: 1920}},
+		{format: "jxr", size: "1080h", expected: Variant{Format: "jxr", Height: 1080}},
+		{format: "png", size: "original", err: true},
+		{format: "jpg", size: "1920", err: true},
+		{format: "jpg", size: "0w", err: true},
+		{format: "jpg", size: "w", err: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.format+":"+c.size, func(t *testing.T) {
+			v, err := ParseVariant(c.format, c.size)
+
+			if c.err {
+				if err == nil {
+					t.Fatalf("Expected an error, got %+v", v)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if v != c.expected {
+				t.Fatalf("Expected %+v, got %+v", c.expected, v)
+			}
+
+			if s := v.String(); s != c.format+":"+c.size {
+				t.Fatalf("Unexpected string %q", s)
+			}
+		})
+	}
+}
+
+func TestParseVariants(t *testing.T) {
+	variants, err := ParseVariants([]string{"jpg", "webp"}, []string{"original", "640w"}, []string{"jxr:1080h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Variant{
+		{Format: "jpg"},
+		{Format: "jpg", Width: 640},
+		{Format: "webp"},
+		{Format: "webp", Width: 640},
+		{Format: "jxr", Height: 1080},
+	}
+
+	if len(variants) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, variants)
+	}
+
+	for n := range expected {
+		if variants[n] != expected[n] {
+			t.Fatalf("Expected %v, got %v", expected, variants)
+		}
+	}
+
+	if _, err := ParseVariants(nil, nil, []string{"webp"}); err == nil {
+		t.Fatal("Presets without a size should be rejected")
+	}
+}
+
+func TestImage_Warm(t *testing.T) {
+	dir, err := ioutil.TempDir("", "warm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	imagesDir := filepath.Join(dir, "images")
+	cacheDir := filepath.Join(dir, "cache")
+
+	if err := os.MkdirAll(filepath.Join(imagesDir, "album"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"a.jpg", "album/b.png", "album/notes.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(imagesDir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	variants := []Variant{
+		{Format: "jpg"},
+		{Format: "webp", Width: 640},
+	}
+
+	controller := gomock.NewController(t)
+
+	var (
+		decoded int
+		m       sync.Mutex
+	)
+
+	i := NewImage(imagesDir, ImageOptions{CacheDir: cacheDir, Quality: 80})
+	i.imageControllerCtor = func(_ context.Context, path string) (imageController, error) {
+		m.Lock()
+		decoded++
+		m.Unlock()
+
+		if filepath.Base(path) == "b.png" {
+			return nil, errors.New("corrupted image")
+		}
+
+		mockIC := mock_handlers.NewMockimageController(controller)
+		mockIC.EXPECT().StripMetadata(img.StripAll)
+		mockIC.EXPECT().Resize(gomock.Any(), gomock.Any()).AnyTimes()
+		mockIC.EXPECT().SetQuality(uint(80))
+		mockIC.EXPECT().Convert(gomock.Any())
+		mockIC.EXPECT().WriteTo(gomock.Any()).DoAndReturn(func(w io.Writer) (int64, error) {
+			n, err := io.WriteString(w, "rendered")
+			return int64(n), err
+		})
+		mockIC.EXPECT().Destroy()
+
+		return mockIC, nil
+	}
+
+	warm := func(t *testing.T) []WarmProgress {
+		var progress []WarmProgress
+
+		failed, err := i.Warm(context.Background(), variants, 2, func(p WarmProgress) {
+			progress = append(progress, p)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if failed != 2 {
+			t.Fatalf("Expected 2 failures, got %d", failed)
+		}
+
+		if len(progress) != 4 {
+			t.Fatalf("Expected 4 progress reports, got %d", len(progress))
+		}
+
+		for n, p := range progress {
+			if p.Done != n+1 || p.Total != 4 {
+				t.Fatalf("Unexpected progress %d/%d", p.Done, p.Total)
+			}
+
+			if (p.Err != nil) != (filepath.Base(p.Path) == "b.png") {
+				t.Fatalf("Unexpected error for %s: %v", p.Path, p.Err)
+			}
+		}
+
+		return progress
+	}
+
+	t.Run("render", func(t *testing.T) {
+		for _, p := range warm(t) {
+			if p.Cached {
+				t.Fatalf("%s as %s should not be cached yet", p.Path, p.Variant)
+			}
+		}
+
+		if decoded != 4 {
+			t.Fatalf("Expected 4 decodes, got %d", decoded)
+		}
+	})
+
+	t.Run("already cached", func(t *testing.T) {
+		decoded = 0
+
+		for _, p := range warm(t) {
+			if p.Err == nil && !p.Cached {
+				t.Fatalf("%s as %s should be cached", p.Path, p.Variant)
+			}
+		}
+
+		// Only the failed image is decoded again
+		if decoded != 2 {
+			t.Fatalf("Expected 2 decodes, got %d", decoded)
+		}
+	})
+
+	t.Run("served from cache", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/a.jpg?width=640", nil)
+		req.Header.Set("Accept", "image/webp")
+
+		w := httptest.NewRecorder()
+
+		decoded = 0
+
+		i.ServeHTTP(w, req)
+
+		res := w.Result()
+
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("Got HTTP %d", res.StatusCode)
+		}
+
+		if decoded != 0 {
+			t.Fatal("The image should not be decoded")
+		}
+
+		if b, _ := ioutil.ReadAll(res.Body); string(b) != "rendered" {
+			t.Fatalf("Unexpected body %q", b)
+		}
+
+		if cl := res.Header.Get("Content-Length"); cl != "8" {
+			t.Fatalf("Unexpected Content-Length %q", cl)
+		}
+
+		if ct := res.Header.Get("Content-Type"); ct != "image/webp" {
+			t.Fatalf("Unexpected Content-Type %q", ct)
+		}
+	})
+
+	t.Run("no cache directory", func(t *testing.T) {
+		if _, err := NewImage(imagesDir, ImageOptions{}).Warm(context.Background(), variants, 1, nil); err == nil {
+			t.Fatal("Expected an error")
+		}
+	})
+}
@@ -1,64 +1,333 @@
 package image
 
 import (
+	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"os"
 
 	"gopkg.in/gographics/imagick.v2/imagick"
 )
 
+// Color is an 8-bit sRGB color.
+type Color struct {
+	R, G, B uint
+}
+
+// String returns the color in hexadecimal notation, e.g. #1A2B3C.
+func (c Color) String() string {
+	return fmt.Sprintf("#%02X%02X%02X", c.R, c.G, c.B)
+}
+
 type ImageMagickProcessor struct {
-	mw *imagick.MagickWand
+	mw      *imagick.MagickWand
+	monitor *progressMonitor
+
+	format      string
+	orientation imagick.OrientationType
+	srgb        bool
+
+	// ctx and path are kept by pinged processors, which decode the pixels
+	// on demand.
+	ctx    context.Context
+	path   string
+	pinged bool
+}
+
+// reducedDecodeSize bounds the size at which the pixels of pinged images are
+// decoded. The JPEG decoder scales images down while decoding them, which is
+// much cheaper than a full decode.
+const reducedDecodeSize = "256x256"
+
+// mainColorPaletteSize is the number of colors of the palette the main color
+// is picked from. It matches the palettes served by the handlers, so that the
+// main color is their dominant color.
+const mainColorPaletteSize = 5
+
+// toSRGB converts the image in mw to sRGB. If the image has an embedded ICC
+// profile, it is used as the source of the transformation, which leaves the
+// compact sRGB profile in place.
+func toSRGB(mw *imagick.MagickWand) error {
+	if mw.GetImageProfile("icc") != "" {
+		if err := mw.ProfileImage("icc", srgbProfile); err != nil {
+			return fmt.Errorf("could not apply the sRGB profile: %v", err)
+		}
+
+		return nil
+	}
+
+	if mw.GetImageColorspace() != imagick.COLORSPACE_SRGB {
+		if err := mw.TransformImageColorspace(imagick.COLORSPACE_SRGB); err != nil {
+			return fmt.Errorf("could not transform the color space: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// NewImagickProcessor reads the image at path. Decoding, and any later
+// operation on the image, is aborted once ctx is done; the processor must
+// still be destroyed.
+func NewImagickProcessor(ctx context.Context, path string) (*ImageMagickProcessor, error) {
+	mw := imagick.NewMagickWand()
+
+	imp := &ImageMagickProcessor{
+		mw:      mw,
+		monitor: monitorProgress(ctx, mw),
+	}
+
+	if err := mw.ReadImage(path); err != nil {
+		imp.Destroy()
+		return nil, err
+	}
+
+	imp.orientation = mw.GetImageOrientation()
+
+	// Apply the EXIF Orientation tag to the pixels before anything else, so
+	// that dimensions, crops and the output match what viewers display. The
+	// tag itself is reset to top-left when the image is written.
+	if err := mw.AutoOrientImage(); err != nil {
+		imp.Destroy()
+		return nil, fmt.Errorf("could not auto-orient the image: %v", err)
+	}
+
+	return imp, nil
 }
 
-func NewImagickProcessor(path string) (*ImageMagickProcessor, error) {
+// PingImagickProcessor reads the dimensions and properties of the image at
+// path without decoding its pixels. Its main color is computed from a reduced
+// decode; it is not meant to be rendered.
+func PingImagickProcessor(ctx context.Context, path string) (*ImageMagickProcessor, error) {
 	mw := imagick.NewMagickWand()
-	err := mw.ReadImage(path)
 
-	return &ImageMagickProcessor{mw: mw}, err
+	imp := &ImageMagickProcessor{
+		mw:      mw,
+		monitor: monitorProgress(ctx, mw),
+		ctx:     ctx,
+		path:    path,
+		pinged:  true,
+	}
+
+	if err := mw.PingImage(path); err != nil {
+		imp.Destroy()
+		return nil, err
+	}
+
+	imp.orientation = mw.GetImageOrientation()
+
+	return imp, nil
 }
 
 func (imp *ImageMagickProcessor) Bytes() []byte {
 	return imp.mw.GetImageBlob()
 }
 
+// ConvertToSRGB converts the image to sRGB. If keepProfile is true, a compact
+// sRGB ICC profile is embedded in the image; otherwise, any ICC profile is
+// removed.
+func (imp *ImageMagickProcessor) ConvertToSRGB(keepProfile bool) error {
+	if !imp.srgb {
+		if err := toSRGB(imp.mw); err != nil {
+			return err
+		}
+
+		imp.srgb = true
+	}
+
+	if keepProfile {
+		if err := imp.mw.SetImageProfile("icc", srgbProfile); err != nil {
+			return fmt.Errorf("could not embed the sRGB profile: %v", err)
+		}
+	} else {
+		imp.mw.RemoveImageProfile("icc")
+	}
+
+	return nil
+}
+
 func (imp *ImageMagickProcessor) Convert(format string) error {
-	return imp.mw.SetFormat(format)
+	if err := imp.mw.SetFormat(format); err != nil {
+		return err
+	}
+
+	imp.format = format
+
+	return nil
 }
 
 func (imp *ImageMagickProcessor) Destroy() {
 	imp.mw.Destroy()
+	imp.monitor.release()
+}
+
+// Dimensions returns the height and width of the image, as displayed.
+func (imp *ImageMagickProcessor) Dimensions() (uint, uint) {
+	height, width := imp.mw.GetImageHeight(), imp.mw.GetImageWidth()
+
+	// Pinged images are not auto-oriented
+	if imp.pinged {
+		switch imp.orientation {
+		case imagick.ORIENTATION_LEFT_TOP, imagick.ORIENTATION_RIGHT_TOP, imagick.ORIENTATION_RIGHT_BOTTOM, imagick.ORIENTATION_LEFT_BOTTOM:
+			return width, height
+		}
+	}
+
+	return height, width
 }
 
 func (imp *ImageMagickProcessor) ExifField(name string) string {
 	return imp.mw.GetImageProperty(name)
 }
 
+// Format returns the format of the decoded image, e.g. JPEG.
 func (imp *ImageMagickProcessor) Format() string {
-	return imp.mw.GetFormat()
+	return imp.mw.GetImageFormat()
 }
 
+// MainColor returns the dominant color of the palette of the image.
 func (imp *ImageMagickProcessor) MainColor() (uint, uint, uint, error) {
+	if !imp.pinged {
+		return mainColor(imp.mw, imp.srgb)
+	}
+
+	mw := imagick.NewMagickWand()
+	monitor := monitorProgress(imp.ctx, mw)
+
+	defer func() {
+		mw.Destroy()
+		monitor.release()
+	}()
+
+	if err := mw.SetOption("jpeg:size", reducedDecodeSize); err != nil {
+		return 0, 0, 0, fmt.Errorf("could not set the decoding size: %v", err)
+	}
+
+	if err := mw.ReadImage(imp.path); err != nil {
+		return 0, 0, 0, err
+	}
+
+	return mainColor(mw, false)
+}
+
+// mainColor returns the dominant color of the image in mw, which is the first
+// color of its palette; srgb is true if it is in sRGB already. Unlike the
+// average color, it is a color that appears in the image.
+func mainColor(mw *imagick.MagickWand, srgb bool) (uint, uint, uint, error) {
+	p, err := palette(mw, srgb, mainColorPaletteSize)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	if len(p.Colors) == 0 {
+		return 0, 0, 0, errors.New("the image has no pixels")
+	}
+
+	c := p.Colors[0].Color
+
+	return c.R, c.G, c.B, nil
+}
+
+// Orientation returns the EXIF orientation (1 to 8) the image was stored with,
+// before it was auto-oriented. It returns 0 if the orientation is unknown.
+func (imp *ImageMagickProcessor) Orientation() uint {
+	return uint(imp.orientation)
+}
+
+// Palette returns the palette of the image, with at most n colors.
+func (imp *ImageMagickProcessor) Palette(n uint) (Palette, error) {
+	return palette(imp.mw, imp.srgb, n)
+}
+
+// palette returns the palette of the image in mw, with at most n colors; srgb
+// is true if it is in sRGB already.
+func palette(mw *imagick.MagickWand, srgb bool, n uint) (Palette, error) {
+	const thumbnailSize = 64
+
+	c := mw.Clone()
+	defer c.Destroy()
+
+	// Always compute the colors in sRGB, as this is what browsers expect
+	if !srgb {
+		if err := toSRGB(c); err != nil {
+			return Palette{}, err
+		}
+	}
+
+	height, width := fitDimensions(c.GetImageHeight(), c.GetImageWidth(), thumbnailSize)
+
+	if err := c.ThumbnailImage(width, height); err != nil {
+		return Palette{}, fmt.Errorf("could not scale the image: %v", err)
+	}
+
+	pixels, err := c.ExportImagePixels(0, 0, width, height, "RGB", imagick.PIXEL_CHAR)
+	if err != nil {
+		return Palette{}, fmt.Errorf("could not export the pixels: %v", err)
+	}
+
+	return extractPalette(pixels.([]byte), int(n)), nil
+}
+
+// Placeholder computes the BlurHash and a tiny preview of the image.
+func (imp *ImageMagickProcessor) Placeholder() (Placeholder, error) {
+	const (
+		previewSize    = 16
+		previewQuality = 50
+		maxComponents  = 4
+		minComponents  = 3
+	)
+
 	c := imp.mw.Clone()
 	defer c.Destroy()
 
-	if err := c.SetDepth(8); err != nil {
-		return 0, 0, 0, fmt.Errorf("could not set the color depth: %v", err)
+	if !imp.srgb {
+		if err := toSRGB(c); err != nil {
+			return Placeholder{}, err
+		}
+	}
+
+	height, width := fitDimensions(c.GetImageHeight(), c.GetImageWidth(), previewSize)
+
+	if err := c.ThumbnailImage(width, height); err != nil {
+		return Placeholder{}, fmt.Errorf("could not scale the image: %v", err)
+	}
+
+	pixels, err := c.ExportImagePixels(0, 0, width, height, "RGB", imagick.PIXEL_CHAR)
+	if err != nil {
+		return Placeholder{}, fmt.Errorf("could not export the pixels: %v", err)
+	}
+
+	xComponents, yComponents := maxComponents, minComponents
+
+	if height > width {
+		xComponents, yComponents = minComponents, maxComponents
 	}
 
-	if err := c.ScaleImage(1, 1); err != nil {
-		return 0, 0, 0, fmt.Errorf("could not scale the image: %v", err)
+	hash, err := blurHash(pixels.([]byte), int(width), int(height), xComponents, yComponents)
+	if err != nil {
+		return Placeholder{}, fmt.Errorf("could not compute the BlurHash: %v", err)
 	}
 
-	_, histo := c.GetImageHistogram()
+	if err := c.StripImage(); err != nil {
+		return Placeholder{}, fmt.Errorf("could not strip the preview: %v", err)
+	}
 
-	p := histo[0]
+	if err := c.SetImageFormat("JPEG"); err != nil {
+		return Placeholder{}, fmt.Errorf("could not set the preview format: %v", err)
+	}
 
-	r := uint(p.GetRed() * 255)
-	g := uint(p.GetGreen() * 255)
-	b := uint(p.GetBlue() * 255)
+	if err := c.SetImageCompressionQuality(previewQuality); err != nil {
+		return Placeholder{}, fmt.Errorf("could not set the preview quality: %v", err)
+	}
 
-	return r, g, b, nil
+	return Placeholder{
+		BlurHash:      hash,
+		Preview:       "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(c.GetImageBlob()),
+		PreviewHeight: height,
+		PreviewWidth:  width,
+	}, nil
 }
 
 func (imp *ImageMagickProcessor) Resize(height, width uint) error {
@@ -106,14 +375,6 @@ resize:
 	//	return fmt.Errorf("Could not set the interlace method: %v", err)
 	//}
 
-	//
-	// Color space
-	//
-
-	//if err := mw.SetColorspace(imagick.COLORSPACE_SRGB); err != nil {
-	//	return fmt.Errorf("Could not set the color space: %v", err)
-	//}
-
 	return nil
 }
 
@@ -131,6 +392,116 @@ func (imp *ImageMagickProcessor) SetQuality(quality uint) error {
 	return nil
 }
 
-func (imp *ImageMagickProcessor) StripEXIF() error {
-	return imp.mw.StripImage()
+// firstProperty returns the first non-empty value among the named properties.
+func (imp *ImageMagickProcessor) firstProperty(names ...string) string {
+	for _, name := range names {
+		if v := imp.mw.GetImageProperty(name); v != "" {
+			return v
+		}
+	}
+
+	return ""
+}
+
+// StripMetadata removes the image metadata according to policy. The ICC
+// profile is always preserved, as removing it would shift the colors.
+func (imp *ImageMagickProcessor) StripMetadata(policy MetadataPolicy) error {
+	if policy == KeepAll {
+		return nil
+	}
+
+	var author, copyright string
+
+	if policy == KeepCopyright {
+		author = imp.firstProperty("exif:Artist", "IPTC:2:80")
+		copyright = imp.firstProperty("exif:Copyright", "IPTC:2:116")
+	}
+
+	icc := imp.mw.GetImageProfile("icc")
+
+	if err := imp.mw.StripImage(); err != nil {
+		return fmt.Errorf("could not strip the metadata: %v", err)
+	}
+
+	if icc != "" {
+		if err := imp.mw.SetImageProfile("icc", []byte(icc)); err != nil {
+			return fmt.Errorf("could not restore the ICC profile: %v", err)
+		}
+	}
+
+	if xmp := copyrightXMP(author, copyright); xmp != nil {
+		if err := imp.mw.SetImageProfile("xmp", xmp); err != nil {
+			return fmt.Errorf("could not set the copyright XMP profile: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// WriteTo encodes the image and streams it to w as ImageMagick produces it,
+// without holding the whole encoded image in memory. If writing to w fails,
+// or if the context of the processor is done, encoding is aborted.
+func (imp *ImageMagickProcessor) WriteTo(w io.Writer) (int64, error) {
+	// Without an explicit format prefix, ImageMagick would pick the output
+	// format from the extension of the source file.
+	if imp.format != "" {
+		if err := imp.mw.SetImageFilename(imp.format + ":"); err != nil {
+			return 0, fmt.Errorf("could not set the output format: %v", err)
+		}
+	}
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return 0, fmt.Errorf("could not create a pipe: %v", err)
+	}
+
+	encodeErr := make(chan error, 1)
+
+	go func() {
+		err := imp.mw.WriteImageFile(pw)
+		pw.Close()
+		encodeErr <- err
+	}()
+
+	n, err := io.Copy(w, pr)
+
+	// If we stopped reading early, this makes ImageMagick's writes fail so
+	// that it returns as soon as possible.
+	pr.Close()
+
+	if eErr := <-encodeErr; err == nil && eErr != nil {
+		err = fmt.Errorf("could not encode the image: %v", eErr)
+	}
+
+	return n, err
+}
+
+// SelfTest returns an error if ImageMagick is not initialized or cannot encode
+// a 1x1 image.
+func SelfTest() error {
+	if !imagick.IsCoreInstantiated() {
+		return errors.New("ImageMagick is not initialized")
+	}
+
+	mw := imagick.NewMagickWand()
+	defer mw.Destroy()
+
+	pw := imagick.NewPixelWand()
+	defer pw.Destroy()
+
+	pw.SetColor("white")
+
+	if err := mw.NewImage(1, 1, pw); err != nil {
+		return fmt.Errorf("could not create an image: %v", err)
+	}
+
+	if err := mw.SetImageFormat("jpeg"); err != nil {
+		return fmt.Errorf("could not set the format: %v", err)
+	}
+
+	if len(mw.GetImageBlob()) == 0 {
+		return errors.New("could not encode the image")
+	}
+
+	return nil
 }
@@ -0,0 +1,262 @@
+package image
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"gopkg.in/gographics/imagick.v2/imagick"
+)
+
+func TestMain(m *testing.M) {
+	imagick.Initialize()
+
+	code := m.Run()
+
+	imagick.Terminate()
+
+	os.Exit(code)
+}
+
+// requireImageMagick skips the test if ImageMagick cannot encode images, e.g.
+// if it was built against a stub.
+func requireImageMagick(t *testing.T) {
+	if err := SelfTest(); err != nil {
+		t.Skipf("ImageMagick is not available: %v", err)
+	}
+}
+
+// newTestProcessor returns a processor for a plain red image.
+func newTestProcessor(t *testing.T, width, height uint) *ImageMagickProcessor {
+	requireImageMagick(t)
+
+	mw := imagick.NewMagickWand()
+
+	pw := imagick.NewPixelWand()
+	defer pw.Destroy()
+
+	pw.SetColor("red")
+
+	if err := mw.NewImage(width, height, pw); err != nil {
+		mw.Destroy()
+		t.Fatal(err)
+	}
+
+	return &ImageMagickProcessor{
+		mw:      mw,
+		monitor: monitorProgress(context.Background(), mw),
+	}
+}
+
+// failingWriter fails once more than limit bytes were written to it, like a
+// connection reset by the client.
+type failingWriter struct {
+	limit   int
+	written int
+}
+
+func (fw *failingWriter) Write(b []byte) (int, error) {
+	if fw.written+len(b) > fw.limit {
+		return 0, errors.New("connection reset by peer")
+	}
+
+	fw.written += len(b)
+
+	return len(b), nil
+}
+
+// openFiles returns the number of open file descriptors, or -1 if unknown.
+func openFiles() int {
+	fis, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+
+	return len(fis)
+}
+
+func TestImageMagickProcessor_WriteTo(t *testing.T) {
+	// PPM is not compressed: 3 MB, much more than a pipe buffers
+	const width, height = 1000, 1000
+
+	t.Run("streams the image", func(t *testing.T) {
+		imp := newTestProcessor(t, width, height)
+		defer imp.Destroy()
+
+		if err := imp.Convert("ppm"); err != nil {
+			t.Fatal(err)
+		}
+
+		var b bytes.Buffer
+
+		n, err := imp.WriteTo(&b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n != int64(b.Len()) || n < 3*width*height || !bytes.HasPrefix(b.Bytes(), []byte("P6\n")) {
+			t.Fatalf("Unexpected image of %d bytes, %d written", b.Len(), n)
+		}
+	})
+
+	t.Run("writer failing mid-stream", func(t *testing.T) {
+		imp := newTestProcessor(t, width, height)
+		defer imp.Destroy()
+
+		if err := imp.Convert("ppm"); err != nil {
+			t.Fatal(err)
+		}
+
+		goroutines, files := runtime.NumGoroutine(), openFiles()
+
+		fw := &failingWriter{limit: 100 << 10}
+
+		done := make(chan error, 1)
+
+		go func() {
+			_, err := imp.WriteTo(fw)
+			done <- err
+		}()
+
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Fatal("Expected an error")
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("WriteTo is stuck after the writer failed")
+		}
+
+		if fw.written > fw.limit {
+			t.Fatalf("%d bytes written", fw.written)
+		}
+
+		// The encoding goroutine and the pipe are released
+		deadline := time.Now().Add(5 * time.Second)
+
+		for runtime.NumGoroutine() > goroutines && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		if n := runtime.NumGoroutine(); n > goroutines {
+			t.Fatalf("%d goroutines leaked", n-goroutines)
+		}
+
+		if n := openFiles(); n > files {
+			t.Fatalf("%d file descriptors leaked", n-files)
+		}
+	})
+}
+
+func TestNewImagickProcessor_orientation(t *testing.T) {
+	requireImageMagick(t)
+
+	// 40x20, left half red and right half blue, stored with Orientation=6:
+	// viewers rotate it by 90° clockwise.
+	const path = "testdata/orientation-6.jpg"
+
+	t.Run("auto-oriented", func(t *testing.T) {
+		imp, err := NewImagickProcessor(context.Background(), path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer imp.Destroy()
+
+		if height, width := imp.Dimensions(); height != 40 || width != 20 {
+			t.Fatalf("Expected 40x20 (HxW), got %dx%d", height, width)
+		}
+
+		if o := imp.Orientation(); o != 6 {
+			t.Fatalf("Expected the source orientation 6, got %d", o)
+		}
+
+		if o := imp.mw.GetImageOrientation(); o != imagick.ORIENTATION_TOP_LEFT {
+			t.Fatalf("Expected the image to be top-left after auto-orientation, got %d", o)
+		}
+
+		for _, tc := range []struct {
+			y     int
+			isRed bool
+			where string
+		}{
+			{y: 5, isRed: true, where: "top"},
+			{y: 35, isRed: false, where: "bottom"},
+		} {
+			pw, err := imp.mw.GetImagePixelColor(10, tc.y)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			red := pw.GetRed() > 0.8 && pw.GetBlue() < 0.2
+
+			pw.Destroy()
+
+			if red != tc.isRed {
+				t.Fatalf("Unexpected color at the %s of the image", tc.where)
+			}
+		}
+	})
+
+	t.Run("pinged", func(t *testing.T) {
+		imp, err := PingImagickProcessor(context.Background(), path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer imp.Destroy()
+
+		if height, width := imp.Dimensions(); height != 40 || width != 20 {
+			t.Fatalf("Expected 40x20 (HxW), got %dx%d", height, width)
+		}
+
+		if o := imp.Orientation(); o != 6 {
+			t.Fatalf("Expected the source orientation 6, got %d", o)
+		}
+	})
+}
+
+func TestImageMagickProcessor_MainColor(t *testing.T) {
+	requireImageMagick(t)
+
+	// 3/4 red and 1/4 blue: the average would be a purple absent from the image
+	const width, height = 40, 10
+
+	pixels := make([]byte, 0, 3*width*height)
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if x < 3*width/4 {
+				pixels = append(pixels, 0xFF, 0, 0)
+			} else {
+				pixels = append(pixels, 0, 0, 0xFF)
+			}
+		}
+	}
+
+	mw := imagick.NewMagickWand()
+
+	if err := mw.ConstituteImage(width, height, "RGB", imagick.PIXEL_CHAR, pixels); err != nil {
+		mw.Destroy()
+		t.Fatal(err)
+	}
+
+	imp := &ImageMagickProcessor{
+		mw:      mw,
+		monitor: monitorProgress(context.Background(), mw),
+		srgb:    true,
+	}
+	defer imp.Destroy()
+
+	r, g, b, err := imp.MainColor()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r < 0xF0 || g > 0x10 || b > 0x10 {
+		t.Fatalf("Expected red, got #%02X%02X%02X", r, g, b)
+	}
+}
@@ -0,0 +1,80 @@
+package image
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+)
+
+// MetadataPolicy selects which metadata is left in images after stripping.
+type MetadataPolicy int
+
+const (
+	// StripAll removes all metadata. ICC profiles are color data and are kept.
+	StripAll MetadataPolicy = iota
+
+	// KeepCopyright removes all metadata except the author and copyright notice.
+	KeepCopyright
+
+	// KeepAll leaves the metadata untouched.
+	KeepAll
+)
+
+var metadataPolicyNames = map[string]MetadataPolicy{
+	"strip":     StripAll,
+	"copyright": KeepCopyright,
+	"keep":      KeepAll,
+}
+
+// ParseMetadataPolicy returns the MetadataPolicy named s: "strip",
+// "copyright" or "keep".
+func ParseMetadataPolicy(s string) (MetadataPolicy, error) {
+	policy, ok := metadataPolicyNames[s]
+	if !ok {
+		return 0, fmt.Errorf("%q: invalid metadata policy", s)
+	}
+
+	return policy, nil
+}
+
+func (mp MetadataPolicy) String() string {
+	for name, policy := range metadataPolicyNames {
+		if policy == mp {
+			return name
+		}
+	}
+
+	return fmt.Sprintf("MetadataPolicy(%d)", int(mp))
+}
+
+// copyrightXMP returns an XMP packet holding only the author and copyright
+// notice, or nil if both are empty.
+func copyrightXMP(author, copyright string) []byte {
+	if author == "" && copyright == "" {
+		return nil
+	}
+
+	var b bytes.Buffer
+
+	b.WriteString(`<?xpacket begin="" id="W5M0MpCehiHzreSzNTczkc9d"?>`)
+	b.WriteString(`<x:xmpmeta xmlns:x="adobe:ns:meta/">`)
+	b.WriteString(`<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">`)
+	b.WriteString(`<rdf:Description rdf:about="" xmlns:dc="http://purl.org/dc/elements/1.1/">`)
+
+	if author != "" {
+		b.WriteString(`<dc:creator><rdf:Seq><rdf:li>`)
+		xml.EscapeText(&b, []byte(author))
+		b.WriteString(`</rdf:li></rdf:Seq></dc:creator>`)
+	}
+
+	if copyright != "" {
+		b.WriteString(`<dc:rights><rdf:Alt><rdf:li xml:lang="x-default">`)
+		xml.EscapeText(&b, []byte(copyright))
+		b.WriteString(`</rdf:li></rdf:Alt></dc:rights>`)
+	}
+
+	b.WriteString(`</rdf:Description></rdf:RDF></x:xmpmeta>`)
+	b.WriteString(`<?xpacket end="r"?>`)
+
+	return b.Bytes()
+}
@@ -0,0 +1,89 @@
+package image
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+func TestParseMetadataPolicy(t *testing.T) {
+	t.Run("valid", func(t *testing.T) {
+		for s, expected := range map[string]MetadataPolicy{
+			"strip":     StripAll,
+			"copyright": KeepCopyright,
+			"keep":      KeepAll,
+		} {
+			policy, err := ParseMetadataPolicy(s)
+			if err != nil {
+				t.Fatalf("%q: %v", s, err)
+			}
+
+			if policy != expected {
+				t.Fatalf("%q: expected %v, got %v", s, expected, policy)
+			}
+
+			if policy.String() != s {
+				t.Fatalf("%q: unexpected name %q", s, policy.String())
+			}
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, s := range []string{"", "Strip", "KEEP", " keep", "keep ", "none", "all"} {
+			if _, err := ParseMetadataPolicy(s); err == nil {
+				t.Fatalf("%q: expected an error", s)
+			}
+		}
+	})
+}
+
+func Test_copyrightXMP(t *testing.T) {
+	t.Run("empty", func(t *testing.T) {
+		if b := copyrightXMP("", ""); b != nil {
+			t.Fatalf("Expected no XMP packet, got %q", b)
+		}
+	})
+
+	t.Run("escaped", func(t *testing.T) {
+		const (
+			author    = `Tom & "Jerry" <tj@example.com>`
+			copyright = `© 2020 </rdf:li></rdf:Alt></dc:rights><dc:title>`
+		)
+
+		b := copyrightXMP(author, copyright)
+
+		var packet struct {
+			Description struct {
+				Creator []string `xml:"creator>Seq>li"`
+				Rights  []string `xml:"rights>Alt>li"`
+				Title   []string `xml:"title"`
+			} `xml:"RDF>Description"`
+		}
+
+		if err := xml.Unmarshal(b, &packet); err != nil {
+			t.Fatalf("Invalid XMP packet %q: %v", b, err)
+		}
+
+		d := packet.Description
+
+		if len(d.Creator) != 1 || d.Creator[0] != author {
+			t.Fatalf("Unexpected creator %q", d.Creator)
+		}
+
+		if len(d.Rights) != 1 || d.Rights[0] != copyright {
+			t.Fatalf("Unexpected rights %q", d.Rights)
+		}
+
+		if len(d.Title) != 0 {
+			t.Fatalf("Unexpected title %q", d.Title)
+		}
+	})
+
+	t.Run("author only", func(t *testing.T) {
+		b := string(copyrightXMP("Jane", ""))
+
+		if !strings.Contains(b, "<rdf:li>Jane</rdf:li>") || strings.Contains(b, "dc:rights") {
+			t.Fatalf("Unexpected XMP packet %q", b)
+		}
+	})
+}
@@ -0,0 +1,261 @@
+package image
+
+import (
+	"math"
+	"sort"
+)
+
+const kMeansIterations = 16
+
+// PaletteColor is a color of a palette, with the proportion of the image it
+// represents.
+type PaletteColor struct {
+	Color
+	Weight float64
+}
+
+// Palette describes the colors of an image.
+type Palette struct {
+	// Colors are the dominant colors of the image, by decreasing weight.
+	Colors []PaletteColor
+
+	// Vibrant is the most saturated color of the palette with a medium
+	// lightness.
+	Vibrant Color
+
+	// Muted is the least saturated color of the palette with a medium
+	// lightness.
+	Muted Color
+
+	// Text is black or white, whichever contrasts most with the dominant
+	// color.
+	Text Color
+}
+
+type rgb [3]float64
+
+func (c rgb) distance(o rgb) float64 {
+	dr, dg, db := c[0]-o[0], c[1]-o[1], c[2]-o[2]
+
+	return dr*dr + dg*dg + db*db
+}
+
+func (c rgb) color() Color {
+	return Color{
+		R: uint(math.Round(c[0])),
+		G: uint(math.Round(c[1])),
+		B: uint(math.Round(c[2])),
+	}
+}
+
+// hsl returns the saturation and lightness of c, between 0 and 1.
+func (c Color) hsl() (float64, float64) {
+	r, g, b := float64(c.R)/255, float64(c.G)/255, float64(c.B)/255
+
+	max := math.Max(r, math.Max(g, b))
+	min := math.Min(r, math.Min(g, b))
+
+	l := (max + min) / 2
+
+	if max == min {
+		return 0, l
+	}
+
+	d := max - min
+
+	if l > 0.5 {
+		return d / (2 - max - min), l
+	}
+
+	return d / (max + min), l
+}
+
+// luminance returns the WCAG relative luminance of c.
+func (c Color) luminance() float64 {
+	return 0.2126*sRGBToLinear(byte(c.R)) + 0.7152*sRGBToLinear(byte(c.G)) + 0.0722*sRGBToLinear(byte(c.B))
+}
+
+// contrastingText returns black or white, whichever has the highest WCAG
+// contrast ratio with c.
+func contrastingText(c Color) Color {
+	l := c.luminance()
+
+	// Contrast with white is 1.05 / (l + 0.05), with black (l + 0.05) / 0.05
+	if 1.05/(l+0.05) >= (l+0.05)/0.05 {
+		return Color{R: 255, G: 255, B: 255}
+	}
+
+	return Color{}
+}
+
+// swatch returns the color of colors closest to the target saturation and
+// lightness, favoring the most represented ones.
+func swatch(colors []PaletteColor, saturation, lightness float64) Color {
+	const (
+		saturationWeight = 3
+		lightnessWeight  = 6
+		populationWeight = 1
+	)
+
+	var (
+		best      Color
+		bestScore = math.Inf(-1)
+	)
+
+	for _, c := range colors {
+		s, l := c.hsl()
+
+		score := saturationWeight*(1-math.Abs(s-saturation)) +
+			lightnessWeight*(1-math.Abs(l-lightness)) +
+			populationWeight*c.Weight
+
+		if score > bestScore {
+			best, bestScore = c.Color, score
+		}
+	}
+
+	return best
+}
+
+// kMeans clusters pixels in at most n groups and returns their centers and
+// sizes. The centers are seeded deterministically, by repeatedly picking the
+// pixel farthest from the existing ones.
+func kMeans(pixels []rgb, n int) ([]rgb, []int) {
+	if len(pixels) == 0 || n < 1 {
+		return nil, nil
+	}
+
+	var mean rgb
+
+	for _, p := range pixels {
+		mean[0] += p[0]
+		mean[1] += p[1]
+		mean[2] += p[2]
+	}
+
+	for i := range mean {
+		mean[i] /= float64(len(pixels))
+	}
+
+	centers := []rgb{mean}
+	nearest := make([]float64, len(pixels))
+
+	for i, p := range pixels {
+		nearest[i] = p.distance(mean)
+	}
+
+	for len(centers) < n {
+		farthest := 0
+
+		for i := range pixels {
+			if nearest[i] > nearest[farthest] {
+				farthest = i
+			}
+		}
+
+		// All pixels are already centers
+		if nearest[farthest] == 0 {
+			break
+		}
+
+		c := pixels[farthest]
+		centers = append(centers, c)
+
+		for i, p := range pixels {
+			nearest[i] = math.Min(nearest[i], p.distance(c))
+		}
+	}
+
+	assignments := make([]int, len(pixels))
+	sizes := make([]int, len(centers))
+
+	for iter := 0; iter < kMeansIterations; iter++ {
+		changed := iter == 0
+
+		for i, p := range pixels {
+			best := 0
+
+			for j := range centers {
+				if p.distance(centers[j]) < p.distance(centers[best]) {
+					best = j
+				}
+			}
+
+			if assignments[i] != best {
+				assignments[i] = best
+				changed = true
+			}
+		}
+
+		if !changed {
+			break
+		}
+
+		sums := make([]rgb, len(centers))
+
+		for j := range sizes {
+			sizes[j] = 0
+		}
+
+		for i, p := range pixels {
+			j := assignments[i]
+
+			sums[j][0] += p[0]
+			sums[j][1] += p[1]
+			sums[j][2] += p[2]
+			sizes[j]++
+		}
+
+		for j := range centers {
+			if sizes[j] != 0 {
+				centers[j] = rgb{
+					sums[j][0] / float64(sizes[j]),
+					sums[j][1] / float64(sizes[j]),
+					sums[j][2] / float64(sizes[j]),
+				}
+			}
+		}
+	}
+
+	return centers, sizes
+}
+
+// extractPalette computes the palette of an image from its 8-bit RGB pixels,
+// with at most n colors.
+func extractPalette(pixels []byte, n int) Palette {
+	points := make([]rgb, 0, len(pixels)/3)
+
+	for i := 0; i+2 < len(pixels); i += 3 {
+		points = append(points, rgb{float64(pixels[i]), float64(pixels[i+1]), float64(pixels[i+2])})
+	}
+
+	centers, sizes := kMeans(points, n)
+
+	var p Palette
+
+	for j, c := range centers {
+		if sizes[j] == 0 {
+			continue
+		}
+
+		p.Colors = append(p.Colors, PaletteColor{
+			Color:  c.color(),
+			Weight: float64(sizes[j]) / float64(len(points)),
+		})
+	}
+
+	if len(p.Colors) == 0 {
+		p.Text = contrastingText(Color{})
+		return p
+	}
+
+	sort.SliceStable(p.Colors, func(i, j int) bool {
+		return p.Colors[i].Weight > p.Colors[j].Weight
+	})
+
+	p.Vibrant = swatch(p.Colors, 1, 0.5)
+	p.Muted = swatch(p.Colors, 0.3, 0.5)
+	p.Text = contrastingText(p.Colors[0].Color)
+
+	return p
+}
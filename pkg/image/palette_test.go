@@ -0,0 +1,63 @@
+package image
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func Test_extractPalette(t *testing.T) {
+	t.Run("two colors", func(t *testing.T) {
+		red := []byte{0xFF, 0, 0}
+		blue := []byte{0, 0, 0xFF}
+
+		pixels := append(bytes.Repeat(red, 75), bytes.Repeat(blue, 25)...)
+
+		p := extractPalette(pixels, 5)
+
+		if len(p.Colors) != 2 {
+			t.Fatalf("Expected 2 colors, got %v", p.Colors)
+		}
+
+		if c := p.Colors[0]; c.Color != (Color{R: 255}) || math.Abs(c.Weight-0.75) > 1e-9 {
+			t.Fatalf("Unexpected dominant color %+v", c)
+		}
+
+		if c := p.Colors[1]; c.Color != (Color{B: 255}) || math.Abs(c.Weight-0.25) > 1e-9 {
+			t.Fatalf("Unexpected second color %+v", c)
+		}
+
+		if p.Text != (Color{}) {
+			t.Fatalf("Expected black text on red, got %v", p.Text)
+		}
+	})
+
+	t.Run("vibrant and muted", func(t *testing.T) {
+		vibrant := []byte{0x20, 0xE0, 0x20}
+		muted := []byte{0x70, 0x80, 0x70}
+		dark := []byte{0x10, 0x10, 0x10}
+
+		pixels := append(bytes.Repeat(dark, 60), bytes.Repeat(vibrant, 20)...)
+		pixels = append(pixels, bytes.Repeat(muted, 20)...)
+
+		p := extractPalette(pixels, 3)
+
+		if p.Vibrant != (Color{R: 0x20, G: 0xE0, B: 0x20}) {
+			t.Fatalf("Unexpected vibrant color %v", p.Vibrant)
+		}
+
+		if p.Muted != (Color{R: 0x70, G: 0x80, B: 0x70}) {
+			t.Fatalf("Unexpected muted color %v", p.Muted)
+		}
+
+		if p.Text != (Color{R: 255, G: 255, B: 255}) {
+			t.Fatalf("Expected white text on a dark color, got %v", p.Text)
+		}
+	})
+
+	t.Run("no pixels", func(t *testing.T) {
+		if p := extractPalette(nil, 5); len(p.Colors) != 0 {
+			t.Fatalf("Expected no colors, got %v", p.Colors)
+		}
+	})
+}
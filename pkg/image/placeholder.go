@@ -0,0 +1,158 @@
+package image
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+const blurHashCharacters = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// Placeholder holds low-quality representations of an image, to be displayed
+// while the image loads.
+type Placeholder struct {
+	// BlurHash is the BlurHash (https://blurha.sh) of the image.
+	BlurHash string
+
+	// Preview is a tiny JPEG version of the image, as a data URI.
+	Preview string
+
+	// PreviewHeight and PreviewWidth are the dimensions of Preview.
+	PreviewHeight uint
+	PreviewWidth  uint
+}
+
+// fitDimensions scales height and width so that the longest side is size,
+// keeping the aspect ratio.
+func fitDimensions(height, width, size uint) (uint, uint) {
+	if height == 0 || width == 0 {
+		return size, size
+	}
+
+	if width >= height {
+		h := uint(math.Round(float64(height) * float64(size) / float64(width)))
+
+		if h == 0 {
+			h = 1
+		}
+
+		return h, size
+	}
+
+	w := uint(math.Round(float64(width) * float64(size) / float64(height)))
+
+	if w == 0 {
+		w = 1
+	}
+
+	return size, w
+}
+
+func encode83(b *strings.Builder, value, length int) {
+	for i := 1; i <= length; i++ {
+		digit := (value / int(math.Pow(83, float64(length-i)))) % 83
+		b.WriteByte(blurHashCharacters[digit])
+	}
+}
+
+func sRGBToLinear(v byte) float64 {
+	f := float64(v) / 255
+
+	if f <= 0.04045 {
+		return f / 12.92
+	}
+
+	return math.Pow((f+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(f float64) int {
+	f = math.Max(0, math.Min(1, f))
+
+	if f <= 0.0031308 {
+		return int(f*12.92*255 + 0.5)
+	}
+
+	return int((1.055*math.Pow(f, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
+
+// blurHash computes the BlurHash of an image from its 8-bit RGB pixels, using
+// xComponents horizontal and yComponents vertical components.
+func blurHash(pixels []byte, width, height, xComponents, yComponents int) (string, error) {
+	if xComponents < 1 || xComponents > 9 || yComponents < 1 || yComponents > 9 {
+		return "", fmt.Errorf("invalid number of components %dx%d", xComponents, yComponents)
+	}
+
+	if width < 1 || height < 1 || len(pixels) < width*height*3 {
+		return "", fmt.Errorf("not enough pixels for a %dx%d image", width, height)
+	}
+
+	factors := make([][3]float64, 0, xComponents*yComponents)
+
+	for j := 0; j < yComponents; j++ {
+		for i := 0; i < xComponents; i++ {
+			var f [3]float64
+
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					basis := math.Cos(math.Pi*float64(i*x)/float64(width)) *
+						math.Cos(math.Pi*float64(j*y)/float64(height))
+
+					p := pixels[3*(y*width+x):]
+
+					f[0] += basis * sRGBToLinear(p[0])
+					f[1] += basis * sRGBToLinear(p[1])
+					f[2] += basis * sRGBToLinear(p[2])
+				}
+			}
+
+			normalisation := 2.0
+
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+
+			scale := normalisation / float64(width*height)
+
+			factors = append(factors, [3]float64{f[0] * scale, f[1] * scale, f[2] * scale})
+		}
+	}
+
+	var b strings.Builder
+
+	encode83(&b, (xComponents-1)+(yComponents-1)*9, 1)
+
+	dc, ac := factors[0], factors[1:]
+
+	maxValue := 1.0
+
+	if len(ac) > 0 {
+		actualMax := 0.0
+
+		for _, f := range ac {
+			actualMax = math.Max(actualMax, math.Max(math.Abs(f[0]), math.Max(math.Abs(f[1]), math.Abs(f[2]))))
+		}
+
+		quantisedMax := int(math.Max(0, math.Min(82, math.Floor(actualMax*166-0.5))))
+		maxValue = float64(quantisedMax+1) / 166
+
+		encode83(&b, quantisedMax, 1)
+	} else {
+		encode83(&b, 0, 1)
+	}
+
+	encode83(&b, linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4)
+
+	quantise := func(v float64) int {
+		return int(math.Max(0, math.Min(18, math.Floor(signPow(v/maxValue, 0.5)*9+9.5))))
+	}
+
+	for _, f := range ac {
+		encode83(&b, quantise(f[0])*19*19+quantise(f[1])*19+quantise(f[2]), 2)
+	}
+
+	return b.String(), nil
+}
@@ -0,0 +1,83 @@
+package image
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func Test_blurHash(t *testing.T) {
+	t.Run("solid color", func(t *testing.T) {
+		pixels := bytes.Repeat([]byte{0xFF, 0x00, 0x80}, 4*3)
+
+		hash, err := blurHash(pixels, 4, 3, 1, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// No AC components, and the DC component is the color itself
+		var b strings.Builder
+
+		encode83(&b, 0, 1)
+		encode83(&b, 0, 1)
+		encode83(&b, 0xFF0080, 4)
+
+		if hash != b.String() {
+			t.Fatalf("Expected %q, got %q", b.String(), hash)
+		}
+	})
+
+	t.Run("length", func(t *testing.T) {
+		pixels := make([]byte, 8*8*3)
+
+		for i := range pixels {
+			pixels[i] = byte(i)
+		}
+
+		hash, err := blurHash(pixels, 8, 8, 4, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// 1 size flag, 1 maximum, 4 DC, 2 per AC component
+		if expected := 1 + 1 + 4 + 2*(4*3-1); len(hash) != expected {
+			t.Fatalf("Expected %d characters, got %d (%q)", expected, len(hash), hash)
+		}
+
+		if hash[0] != blurHashCharacters[3+2*9] {
+			t.Fatalf("Unexpected size flag %q", hash[0])
+		}
+	})
+
+	t.Run("invalid components", func(t *testing.T) {
+		if _, err := blurHash(make([]byte, 3), 1, 1, 0, 10); err == nil {
+			t.Fatal("Expected an error")
+		}
+	})
+
+	t.Run("not enough pixels", func(t *testing.T) {
+		if _, err := blurHash(make([]byte, 3), 2, 2, 1, 1); err == nil {
+			t.Fatal("Expected an error")
+		}
+	})
+}
+
+func Test_fitDimensions(t *testing.T) {
+	cases := []struct {
+		height, width, size uint
+		eHeight, eWidth     uint
+	}{
+		{height: 600, width: 800, size: 16, eHeight: 12, eWidth: 16},
+		{height: 800, width: 600, size: 16, eHeight: 16, eWidth: 12},
+		{height: 1, width: 1000, size: 16, eHeight: 1, eWidth: 16},
+		{height: 0, width: 0, size: 16, eHeight: 16, eWidth: 16},
+	}
+
+	for _, c := range cases {
+		h, w := fitDimensions(c.height, c.width, c.size)
+
+		if h != c.eHeight || w != c.eWidth {
+			t.Fatalf("%dx%d in %d: expected %dx%d, got %dx%d", c.width, c.height, c.size, c.eWidth, c.eHeight, w, h)
+		}
+	}
+}
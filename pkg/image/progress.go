@@ -0,0 +1,80 @@
+package image
+
+/*
+#cgo !no_pkgconfig pkg-config: MagickWand MagickCore
+#include <stdlib.h>
+#include <wand/MagickWand.h>
+
+// cancellableProgress aborts the current ImageMagick operation as soon as the
+// flag passed as client data is set.
+static MagickBooleanType cancellableProgress(const char *text, const MagickOffsetType offset, const MagickSizeType span, void *client_data) {
+	return __atomic_load_n((int *)client_data, __ATOMIC_RELAXED) ? MagickFalse : MagickTrue;
+}
+
+static void setCancellableProgress(void *wand, int *cancelled) {
+	MagickSetProgressMonitor((MagickWand *)wand, cancellableProgress, cancelled);
+}
+
+static void cancel(int *cancelled) {
+	__atomic_store_n(cancelled, 1, __ATOMIC_RELAXED);
+}
+*/
+import "C"
+
+import (
+	"context"
+	"unsafe"
+
+	"gopkg.in/gographics/imagick.v2/imagick"
+)
+
+// progressMonitor aborts the operations of a MagickWand when a context is
+// cancelled. imagick does not expose ImageMagick's progress monitor, so it is
+// registered through cgo.
+type progressMonitor struct {
+	cancelled *C.int
+	done      chan struct{}
+	stop      chan struct{}
+}
+
+// wandPointer returns the C MagickWand wrapped by mw, which is the first field
+// of imagick.MagickWand. That field is not exported, so this depends on the
+// layout of imagick v2.6.0, which go.mod pins; Test_wandPointer_layout fails
+// if an upgrade changes it.
+func wandPointer(mw *imagick.MagickWand) unsafe.Pointer {
+	return *(*unsafe.Pointer)(unsafe.Pointer(mw))
+}
+
+// monitorProgress makes the operations of mw, including reading and writing
+// images, fail once ctx is done. It must be registered before the image is
+// read, as the images of the wand inherit its monitor, and stopped after the
+// wand is destroyed with release.
+func monitorProgress(ctx context.Context, mw *imagick.MagickWand) *progressMonitor {
+	pm := &progressMonitor{
+		cancelled: (*C.int)(C.calloc(1, C.sizeof_int)),
+		done:      make(chan struct{}),
+		stop:      make(chan struct{}),
+	}
+
+	C.setCancellableProgress(wandPointer(mw), pm.cancelled)
+
+	go func() {
+		defer close(pm.done)
+
+		select {
+		case <-ctx.Done():
+			C.cancel(pm.cancelled)
+		case <-pm.stop:
+		}
+	}()
+
+	return pm
+}
+
+// release frees the resources of the monitor. The wand must have been
+// destroyed.
+func (pm *progressMonitor) release() {
+	close(pm.stop)
+	<-pm.done
+	C.free(unsafe.Pointer(pm.cancelled))
+}
@@ -0,0 +1,25 @@
+package image
+
+import (
+	"reflect"
+	"testing"
+	"unsafe"
+
+	"gopkg.in/gographics/imagick.v2/imagick"
+)
+
+// wandPointer reads the C pointer of imagick.MagickWand, which is not
+// exported; this fails if an imagick upgrade changes the layout it relies on.
+func Test_wandPointer_layout(t *testing.T) {
+	typ := reflect.TypeOf(imagick.MagickWand{})
+
+	if typ.NumField() == 0 {
+		t.Fatal("imagick.MagickWand has no fields")
+	}
+
+	f := typ.Field(0)
+
+	if f.Name != "mw" || f.Offset != 0 || f.Type.Kind() != reflect.Ptr || f.Type.Size() != unsafe.Sizeof(unsafe.Pointer(nil)) {
+		t.Fatalf("The first field of imagick.MagickWand is %s %v at offset %d; wandPointer must be updated", f.Name, f.Type, f.Offset)
+	}
+}
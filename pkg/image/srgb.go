@@ -0,0 +1,156 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+)
+
+// srgbProfile is a compact ICC v2 profile describing the sRGB color space.
+// It is small enough to be embedded in every served image.
+var srgbProfile = buildSRGBProfile()
+
+// ColorOptions configures the color management applied to images.
+type ColorOptions struct {
+	// ConvertToSRGB converts images to sRGB using their embedded ICC profile.
+	ConvertToSRGB bool
+
+	// KeepProfile embeds a compact sRGB profile in converted images instead of
+	// leaving them untagged.
+	KeepProfile bool
+}
+
+type iccTag struct {
+	signature string
+	data      []byte
+}
+
+func s15Fixed16(v float64) uint32 {
+	return uint32(int32(math.Round(v * 65536)))
+}
+
+func iccXYZ(x, y, z float64) []byte {
+	b := make([]byte, 20)
+
+	copy(b, "XYZ ")
+	binary.BigEndian.PutUint32(b[8:], s15Fixed16(x))
+	binary.BigEndian.PutUint32(b[12:], s15Fixed16(y))
+	binary.BigEndian.PutUint32(b[16:], s15Fixed16(z))
+
+	return b
+}
+
+func iccText(s string) []byte {
+	b := make([]byte, 8, 8+len(s)+1)
+
+	copy(b, "text")
+
+	return append(append(b, s...), 0)
+}
+
+func iccDescription(s string) []byte {
+	b := make([]byte, 12, 12+len(s)+1+4+4+2+1+67)
+
+	copy(b, "desc")
+	binary.BigEndian.PutUint32(b[8:], uint32(len(s)+1))
+
+	b = append(append(b, s...), 0)
+
+	// Empty Unicode and ScriptCode descriptions
+	return append(b, make([]byte, 4+4+2+1+67)...)
+}
+
+// iccSRGBCurve samples the sRGB transfer function on n points.
+func iccSRGBCurve(n int) []byte {
+	b := make([]byte, 12+2*n)
+
+	copy(b, "curv")
+	binary.BigEndian.PutUint32(b[8:], uint32(n))
+
+	for i := 0; i < n; i++ {
+		v := float64(i) / float64(n-1)
+
+		if v <= 0.04045 {
+			v /= 12.92
+		} else {
+			v = math.Pow((v+0.055)/1.055, 2.4)
+		}
+
+		binary.BigEndian.PutUint16(b[12+2*i:], uint16(math.Round(v*65535)))
+	}
+
+	return b
+}
+
+func buildSRGBProfile() []byte {
+	const (
+		headerSize   = 128
+		tagEntrySize = 12
+	)
+
+	trc := iccSRGBCurve(64)
+
+	tags := []iccTag{
+		{"desc", iccDescription("sRGB")},
+		{"cprt", iccText("No copyright, use freely")},
+		{"wtpt", iccXYZ(0.9642, 1.0, 0.8249)},
+		{"rXYZ", iccXYZ(0.4361, 0.2225, 0.0139)},
+		{"gXYZ", iccXYZ(0.3851, 0.7169, 0.0971)},
+		{"bXYZ", iccXYZ(0.1431, 0.0606, 0.7141)},
+		{"rTRC", trc},
+		{"gTRC", trc},
+		{"bTRC", trc},
+	}
+
+	var data bytes.Buffer
+
+	dataStart := headerSize + 4 + len(tags)*tagEntrySize
+
+	table := make([]byte, 4, 4+len(tags)*tagEntrySize)
+	binary.BigEndian.PutUint32(table, uint32(len(tags)))
+
+	offsets := make(map[*byte]uint32)
+
+	for _, t := range tags {
+		offset, ok := offsets[&t.data[0]]
+		if !ok {
+			// Tag data must be 4-byte aligned
+			for data.Len()%4 != 0 {
+				data.WriteByte(0)
+			}
+
+			offset = uint32(dataStart + data.Len())
+			offsets[&t.data[0]] = offset
+			data.Write(t.data)
+		}
+
+		entry := make([]byte, tagEntrySize)
+
+		copy(entry, t.signature)
+		binary.BigEndian.PutUint32(entry[4:], offset)
+		binary.BigEndian.PutUint32(entry[8:], uint32(len(t.data)))
+
+		table = append(table, entry...)
+	}
+
+	header := make([]byte, headerSize)
+
+	binary.BigEndian.PutUint32(header[0:], uint32(dataStart+data.Len()))
+	binary.BigEndian.PutUint32(header[8:], 0x02100000)
+	copy(header[12:], "mntr")
+	copy(header[16:], "RGB ")
+	copy(header[20:], "XYZ ")
+	binary.BigEndian.PutUint16(header[24:], 2020)
+	binary.BigEndian.PutUint16(header[26:], 1)
+	binary.BigEndian.PutUint16(header[28:], 1)
+	copy(header[36:], "acsp")
+	binary.BigEndian.PutUint32(header[68:], s15Fixed16(0.9642))
+	binary.BigEndian.PutUint32(header[72:], s15Fixed16(1.0))
+	binary.BigEndian.PutUint32(header[76:], s15Fixed16(0.8249))
+
+	profile := make([]byte, 0, dataStart+data.Len())
+	profile = append(profile, header...)
+	profile = append(profile, table...)
+
+	return append(profile, data.Bytes()...)
+}
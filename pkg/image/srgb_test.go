@@ -0,0 +1,76 @@
+package image
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func Test_buildSRGBProfile(t *testing.T) {
+	p := buildSRGBProfile()
+
+	if len(p) < 132 {
+		t.Fatalf("Profile too short: %d bytes", len(p))
+	}
+
+	if size := binary.BigEndian.Uint32(p[0:]); int(size) != len(p) {
+		t.Fatalf("Header size %d, profile of %d bytes", size, len(p))
+	}
+
+	if v := binary.BigEndian.Uint32(p[8:]); v != 0x02100000 {
+		t.Fatalf("Unexpected version %#x", v)
+	}
+
+	for offset, expected := range map[int]string{12: "mntr", 16: "RGB ", 20: "XYZ ", 36: "acsp"} {
+		if s := string(p[offset : offset+4]); s != expected {
+			t.Fatalf("Expected %q at offset %d, got %q", expected, offset, s)
+		}
+	}
+
+	count := int(binary.BigEndian.Uint32(p[128:]))
+	dataStart := 132 + count*12
+
+	if count != 9 || dataStart > len(p) {
+		t.Fatalf("Unexpected tag count %d", count)
+	}
+
+	types := map[string]string{
+		"desc": "desc",
+		"cprt": "text",
+		"wtpt": "XYZ ",
+		"rXYZ": "XYZ ",
+		"gXYZ": "XYZ ",
+		"bXYZ": "XYZ ",
+		"rTRC": "curv",
+		"gTRC": "curv",
+		"bTRC": "curv",
+	}
+
+	offsets := make(map[string]uint32)
+
+	for i := 0; i < count; i++ {
+		entry := p[132+i*12:]
+
+		sig := string(entry[:4])
+		offset := binary.BigEndian.Uint32(entry[4:])
+		size := binary.BigEndian.Uint32(entry[8:])
+
+		if offset%4 != 0 || int(offset) < dataStart || int(offset+size) > len(p) {
+			t.Fatalf("%s: invalid offset %d and size %d", sig, offset, size)
+		}
+
+		if typ := string(p[offset : offset+4]); typ != types[sig] {
+			t.Fatalf("%s: expected type %q, got %q", sig, types[sig], typ)
+		}
+
+		offsets[sig] = offset
+	}
+
+	if len(offsets) != len(types) {
+		t.Fatalf("Unexpected tags %v", offsets)
+	}
+
+	// The TRC tags share the same curve
+	if offsets["rTRC"] != offsets["gTRC"] || offsets["rTRC"] != offsets["bTRC"] {
+		t.Fatalf("TRC tags are not shared: %v", offsets)
+	}
+}
@@ -0,0 +1,344 @@
+package pkg
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// Protocols spoken by the server. HTTP/3 would need a UDP listener and is not
+// supported yet.
+const (
+	// ProtocolAuto is HTTP/1.1 in clear text, and HTTP/2 or HTTP/1.1
+	// negotiated with ALPN over TLS.
+	ProtocolAuto = "auto"
+
+	// ProtocolHTTP1 is HTTP/1.1 only, even over TLS.
+	ProtocolHTTP1 = "http1"
+
+	// ProtocolH2C is HTTP/2 in clear text with prior knowledge, and
+	// HTTP/1.1. Upgrades from HTTP/1.1 are not supported: such requests are
+	// served over HTTP/1.1. It cannot be used with TLS.
+	ProtocolH2C = "h2c"
+)
+
+// ParseProtocol validates a protocol, given whether TLS is enabled.
+func ParseProtocol(protocol string, tls bool) (string, error) {
+	switch protocol {
+	case "":
+		return ProtocolAuto, nil
+	case ProtocolAuto, ProtocolHTTP1:
+		return protocol, nil
+	case ProtocolH2C:
+		if tls {
+			return "", errors.New("h2c cannot be used with TLS")
+		}
+
+		return protocol, nil
+	default:
+		return "", fmt.Errorf("%q: unknown protocol; expected auto, http1 or h2c", protocol)
+	}
+}
+
+// First file descriptor passed by systemd, see sd_listen_fds(3)
+const systemdFirstFD = 3
+
+var (
+	systemdOnce      sync.Once
+	systemdListeners map[string]net.Listener
+	systemdErr       error
+)
+
+// loadSystemdListeners returns the sockets passed by systemd, by name and by
+// index. The environment variables are only read once, and then cleared so
+// that child processes do not inherit them.
+func loadSystemdListeners() (map[string]net.Listener, error) {
+	systemdOnce.Do(func() {
+		defer func() {
+			os.Unsetenv("LISTEN_PID")
+			os.Unsetenv("LISTEN_FDS")
+			os.Unsetenv("LISTEN_FDNAMES")
+		}()
+
+		systemdListeners, systemdErr = systemdListenersFrom(os.Getenv, systemdFirstFD)
+	})
+
+	return systemdListeners, systemdErr
+}
+
+// systemdListenersFrom returns the sockets described by the LISTEN_*
+// variables read with getenv, starting from the file descriptor firstFD, by
+// name and by index.
+func systemdListenersFrom(getenv func(string) string, firstFD int) (map[string]net.Listener, error) {
+	if pid, err := strconv.Atoi(getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, errors.New("no sockets passed by systemd")
+	}
+
+	n, err := strconv.Atoi(getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", getenv("LISTEN_FDS"))
+	}
+
+	names := strings.Split(getenv("LISTEN_FDNAMES"), ":")
+
+	listeners := make(map[string]net.Listener, 2*n)
+
+	for i := 0; i < n; i++ {
+		fd := firstFD + i
+
+		f := os.NewFile(uintptr(fd), fmt.Sprintf("systemd-%d", i))
+
+		ln, err := net.FileListener(f)
+
+		// The listener holds its own copy of the descriptor
+		f.Close()
+
+		if err != nil {
+			return nil, fmt.Errorf("socket %d: %v", i, err)
+		}
+
+		listeners[strconv.Itoa(i)] = ln
+
+		if i < len(names) && names[i] != "" {
+			listeners[names[i]] = ln
+		}
+	}
+
+	return listeners, nil
+}
+
+// Listen returns a listener for addr, which is either:
+//   - host:port, e.g. :8080, for TCP;
+//   - unix:PATH for a Unix domain socket; a stale socket at PATH is removed;
+//   - systemd or systemd:NAME for a socket passed by systemd socket
+//     activation: the first one, or the one with the given
+//     FileDescriptorName= or index.
+func Listen(addr string) (net.Listener, error) {
+	switch {
+	case strings.HasPrefix(addr, "unix:"):
+		path := strings.TrimPrefix(addr, "unix:")
+
+		if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			if err := os.Remove(path); err != nil {
+				return nil, fmt.Errorf("could not remove the stale socket: %v", err)
+			}
+		}
+
+		return net.Listen("unix", path)
+	case addr == "systemd" || strings.HasPrefix(addr, "systemd:"):
+		name := strings.TrimPrefix(strings.TrimPrefix(addr, "systemd"), ":")
+
+		if name == "" {
+			name = "0"
+		}
+
+		listeners, err := loadSystemdListeners()
+		if err != nil {
+			return nil, err
+		}
+
+		ln, ok := listeners[name]
+		if !ok {
+			return nil, fmt.Errorf("%s: no such socket passed by systemd", name)
+		}
+
+		return ln, nil
+	default:
+		return net.Listen("tcp", addr)
+	}
+}
+
+// configureProtocol sets srv up to speak protocol.
+func configureProtocol(srv *http.Server, protocol string) error {
+	switch protocol {
+	case "", ProtocolAuto:
+		if srv.TLSConfig != nil {
+			srv.TLSConfig.NextProtos = []string{"h2", "http/1.1"}
+		}
+	case ProtocolHTTP1:
+		// A non-nil empty map disables HTTP/2
+		srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+
+		if srv.TLSConfig != nil {
+			srv.TLSConfig.NextProtos = []string{"http/1.1"}
+		}
+	case ProtocolH2C:
+		if srv.TLSConfig != nil {
+			return errors.New("h2c cannot be used with TLS")
+		}
+
+		return configureH2C(srv)
+	default:
+		return fmt.Errorf("%q: unknown protocol", protocol)
+	}
+
+	return nil
+}
+
+// h2cHandler serves the HTTP/2 connections opened with prior knowledge, and
+// passes the other requests to next. Unlike with h2c.NewHandler, connections
+// are served with srv as their base configuration, so that its read and write
+// timeouts apply to every stream; they are told to go away when srv shuts
+// down, and closed by close.
+type h2cHandler struct {
+	next http.Handler
+	srv  *http.Server
+	h2   *http2.Server
+
+	// ctx is the base context of the requests; it is cancelled by close.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	closed bool
+	conns  map[net.Conn]struct{}
+	m      sync.Mutex
+}
+
+// configureH2C sets srv up to serve h2c with prior knowledge.
+func configureH2C(srv *http.Server) error {
+	h2 := &http2.Server{}
+
+	// This registers the graceful shutdown of the HTTP/2 connections with
+	// srv, and sets the idle timeout; it also sets srv up for TLS, which is
+	// not used.
+	if err := http2.ConfigureServer(srv, h2); err != nil {
+		return err
+	}
+
+	srv.TLSConfig = nil
+	srv.TLSNextProto = nil
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	srv.Handler = &h2cHandler{
+		next:   srv.Handler,
+		srv:    srv,
+		h2:     h2,
+		ctx:    ctx,
+		cancel: cancel,
+		conns:  make(map[net.Conn]struct{}),
+	}
+
+	return nil
+}
+
+// prefacedConn replays the client preface, which net/http consumed, before
+// the rest of the connection.
+type prefacedConn struct {
+	net.Conn
+
+	r io.Reader
+}
+
+func (c prefacedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (h *h2cHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// net/http parses the beginning of the client preface as a request
+	if r.Method != "PRI" || r.RequestURI != "*" || r.Proto != "HTTP/2.0" || len(r.Header) != 0 {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+
+	conn, rw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		log.Printf("Could not hijack the h2c connection: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+
+	const prefaceEnd = "SM\r\n\r\n"
+
+	b := make([]byte, len(prefaceEnd))
+
+	if _, err := io.ReadFull(rw, b); err != nil || string(b) != prefaceEnd {
+		log.Printf("%s: invalid HTTP/2 client preface", r.RemoteAddr)
+		return
+	}
+
+	if !h.track(conn) {
+		return
+	}
+	defer h.untrack(conn)
+
+	// Drop the deadlines of the first request; srv's timeouts are applied
+	// to each stream instead.
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		log.Printf("Could not reset the deadlines of the h2c connection: %v", err)
+		return
+	}
+
+	h.h2.ServeConn(
+		prefacedConn{Conn: conn, r: io.MultiReader(strings.NewReader(http2.ClientPreface), rw)},
+		&http2.ServeConnOpts{Context: h.ctx, BaseConfig: h.srv, Handler: h.next},
+	)
+}
+
+// track records conn, unless the handler is closed.
+func (h *h2cHandler) track(conn net.Conn) bool {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	if h.closed {
+		return false
+	}
+
+	h.conns[conn] = struct{}{}
+
+	return true
+}
+
+func (h *h2cHandler) untrack(conn net.Conn) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	delete(h.conns, conn)
+}
+
+// close cancels the requests being served over h2c, and closes their
+// connections, which http.Server.Close does not see once hijacked.
+func (h *h2cHandler) close() {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	h.closed = true
+	h.cancel()
+
+	for conn := range h.conns {
+		conn.Close()
+	}
+}
+
+// closeServer closes srv and all of its connections, including h2c ones.
+func closeServer(srv *http.Server) error {
+	err := srv.Close()
+
+	if h, ok := srv.Handler.(*h2cHandler); ok {
+		h.close()
+	}
+
+	return err
+}
+
+// serve serves srv on ln, over TLS if srv has a TLS configuration.
+func serve(srv *http.Server, ln net.Listener) error {
+	if srv.TLSConfig != nil {
+		return srv.ServeTLS(ln, "", "")
+	}
+
+	return srv.Serve(ln)
+}
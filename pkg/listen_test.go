@@ -0,0 +1,337 @@
+package pkg
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+func TestParseProtocol(t *testing.T) {
+	cases := []struct {
+		protocol string
+		tls      bool
+		expected string
+		err      bool
+	}{
+		{protocol: "", expected: ProtocolAuto},
+		{protocol: "http1", tls: true, expected: ProtocolHTTP1},
+		{protocol: "h2c", expected: ProtocolH2C},
+		{protocol: "h2c", tls: true, err: true},
+		{protocol: "h3", err: true},
+	}
+
+	for _, c := range cases {
+		got, err := ParseProtocol(c.protocol, c.tls)
+
+		if (err != nil) != c.err || got != c.expected {
+			t.Fatalf("%q, TLS %t: got %q, %v", c.protocol, c.tls, got, err)
+		}
+	}
+}
+
+func TestListen_unix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "server.sock")
+
+	// Leave a stale socket behind
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := Listen("unix:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	}
+	defer srv.Close()
+
+	go serve(srv, ln)
+
+	client := http.Client{
+		Transport: &http.Transport{
+			Dial: func(string, string) (net.Conn, error) {
+				return net.Dial("unix", path)
+			},
+		},
+	}
+
+	res, err := client.Get("http://unix/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Got HTTP %d", res.StatusCode)
+	}
+}
+
+func TestListen_systemd(t *testing.T) {
+	// Not started by systemd
+	if _, err := Listen("systemd"); err == nil {
+		t.Fatal("Expected an error")
+	}
+}
+
+func Test_systemdListenersFrom(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	f, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// Pass a copy of the socket, which systemdListenersFrom takes over
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := map[string]string{
+		"LISTEN_PID":     strconv.Itoa(os.Getpid()),
+		"LISTEN_FDS":     "1",
+		"LISTEN_FDNAMES": "web",
+	}
+
+	listeners, err := systemdListenersFrom(func(key string) string { return env[key] }, fd)
+	if err != nil {
+		syscall.Close(fd)
+		t.Fatal(err)
+	}
+
+	if len(listeners) != 2 || listeners["0"] == nil || listeners["0"] != listeners["web"] {
+		t.Fatalf("Unexpected listeners %v", listeners)
+	}
+	defer listeners["0"].Close()
+
+	conn, err := net.Dial("tcp", listeners["web"].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	t.Run("other process", func(t *testing.T) {
+		env := map[string]string{"LISTEN_PID": "1", "LISTEN_FDS": "1"}
+
+		if _, err := systemdListenersFrom(func(key string) string { return env[key] }, fd); err == nil {
+			t.Fatal("Expected an error")
+		}
+	})
+}
+
+func Test_configureProtocol(t *testing.T) {
+	newServer := func(t *testing.T, protocol string) (string, *http.Server) {
+		srv := &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-Proto", r.Proto)
+			}),
+		}
+
+		if err := configureProtocol(srv, protocol); err != nil {
+			t.Fatal(err)
+		}
+
+		ln, err := Listen("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		go serve(srv, ln)
+
+		return ln.Addr().String(), srv
+	}
+
+	// HTTP/2 with prior knowledge, without TLS
+	h2Client := http.Client{
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return net.Dial(network, addr)
+			},
+		},
+	}
+
+	t.Run("h2c", func(t *testing.T) {
+		addr, srv := newServer(t, ProtocolH2C)
+		defer srv.Close()
+
+		res, err := h2Client.Get("http://" + addr + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if proto := res.Header.Get("X-Proto"); proto != "HTTP/2.0" {
+			t.Fatalf("Served over %s", proto)
+		}
+	})
+
+	t.Run("HTTP/1.1 only", func(t *testing.T) {
+		addr, srv := newServer(t, ProtocolHTTP1)
+		defer srv.Close()
+
+		if _, err := h2Client.Get("http://" + addr + "/"); err == nil {
+			t.Fatal("HTTP/2 should not be served")
+		}
+
+		res, err := http.Get("http://" + addr + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if proto := res.Header.Get("X-Proto"); proto != "HTTP/1.1" {
+			t.Fatalf("Served over %s", proto)
+		}
+	})
+
+	t.Run("h2c applies the write timeout", func(t *testing.T) {
+		srv := &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(500 * time.Millisecond)
+			}),
+			WriteTimeout: 100 * time.Millisecond,
+		}
+
+		if err := configureProtocol(srv, ProtocolH2C); err != nil {
+			t.Fatal(err)
+		}
+
+		ln, err := Listen("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		go serve(srv, ln)
+		defer closeServer(srv)
+
+		if res, err := h2Client.Get("http://" + ln.Addr().String() + "/"); err == nil {
+			res.Body.Close()
+			t.Fatalf("Expected the stream to time out, got HTTP %d", res.StatusCode)
+		}
+	})
+
+	t.Run("h2c connections are shut down with the server", func(t *testing.T) {
+		var (
+			started = make(chan struct{}, 1)
+			release = make(chan struct{})
+		)
+
+		srv := &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				started <- struct{}{}
+
+				select {
+				case <-release:
+				case <-r.Context().Done():
+				}
+			}),
+		}
+
+		if err := configureProtocol(srv, ProtocolH2C); err != nil {
+			t.Fatal(err)
+		}
+
+		ln, err := Listen("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		go serve(srv, ln)
+
+		url := "http://" + ln.Addr().String() + "/"
+
+		get := func() chan error {
+			errs := make(chan error, 1)
+
+			go func() {
+				res, err := h2Client.Get(url)
+				if err == nil {
+					res.Body.Close()
+				}
+
+				errs <- err
+			}()
+
+			<-started
+
+			return errs
+		}
+
+		// Drained on shutdown
+		errs := get()
+
+		if err := srv.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		close(release)
+
+		if err := <-errs; err != nil {
+			t.Fatalf("The request was not drained: %v", err)
+		}
+
+		// Cancelled on close
+		srv = &http.Server{Handler: srv.Handler.(*h2cHandler).next}
+
+		if err := configureProtocol(srv, ProtocolH2C); err != nil {
+			t.Fatal(err)
+		}
+
+		release = make(chan struct{})
+
+		if ln, err = Listen("127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+
+		go serve(srv, ln)
+
+		url = "http://" + ln.Addr().String() + "/"
+		errs = get()
+
+		closeServer(srv)
+
+		select {
+		case err := <-errs:
+			if err == nil {
+				t.Fatal("The request should have failed")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("The h2c connection was not closed")
+		}
+	})
+
+	t.Run("h2c with TLS", func(t *testing.T) {
+		if err := configureProtocol(&http.Server{TLSConfig: &tls.Config{}}, ProtocolH2C); err == nil {
+			t.Fatal("Expected an error")
+		}
+	})
+}
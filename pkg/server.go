@@ -1,8 +1,13 @@
 package pkg
 
 import (
+	"context"
+	"expvar"
 	"log"
+	"net"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 	"gopkg.in/gographics/imagick.v2/imagick"
@@ -18,28 +23,362 @@ func Logger(next http.Handler) http.Handler {
 	})
 }
 
-func StartServer(addr, dir string, quality uint) error {
+// inFlightRequests counts the requests being served. Unlike with a
+// sync.WaitGroup, requests may start while wait is running, e.g. on a
+// connection accepted just before the listener closed.
+type inFlightRequests struct {
+	n    int
+	cond *sync.Cond
+}
+
+func newInFlightRequests() *inFlightRequests {
+	return &inFlightRequests{cond: sync.NewCond(&sync.Mutex{})}
+}
+
+func (ifr *inFlightRequests) add(delta int) {
+	ifr.cond.L.Lock()
+	defer ifr.cond.L.Unlock()
+
+	ifr.n += delta
+
+	if ifr.n == 0 {
+		ifr.cond.Broadcast()
+	}
+}
+
+// wait returns once no request is being served.
+func (ifr *inFlightRequests) wait() {
+	ifr.cond.L.Lock()
+	defer ifr.cond.L.Unlock()
+
+	for ifr.n != 0 {
+		ifr.cond.Wait()
+	}
+}
+
+// trackInFlight counts the requests being served in ifr.
+func trackInFlight(ifr *inFlightRequests, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ifr.add(1)
+		defer ifr.add(-1)
+
+		next.ServeHTTP(w, req)
+	})
+}
+
+// limitBody rejects the requests whose body is larger than n bytes, and stops
+// reading the bodies once they reach that size. No limit applies if n is 0.
+func limitBody(n int64, next http.Handler) http.Handler {
+	if n <= 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.ContentLength > n {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		req.Body = http.MaxBytesReader(w, req.Body, n)
+
+		next.ServeHTTP(w, req)
+	})
+}
+
+// ShutdownOptions configures how the server stops.
+type ShutdownOptions struct {
+	// Delay is the time during which /readyz reports the server as
+	// draining before it stops accepting connections, so that load
+	// balancers stop sending it traffic.
+	Delay time.Duration
+
+	// DrainTimeout bounds the time given to in-flight requests, e.g. image
+	// renders, to complete. Past it, they are cancelled.
+	DrainTimeout time.Duration
+}
+
+// shutdown reports the server as draining, then stops srv once the requests
+// tracked in inFlight returned.
+func shutdown(srv *http.Server, health *handlers.HealthRegistry, inFlight *inFlightRequests, opts ShutdownOptions) error {
+	log.Print("Shutting down")
+
+	health.SetDraining(true)
+
+	if opts.Delay > 0 {
+		log.Printf("Waiting %v before closing the listener", opts.Delay)
+		time.Sleep(opts.Delay)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), opts.DrainTimeout)
+	defer cancel()
+
+	err := srv.Shutdown(ctx)
+	if err != nil {
+		log.Printf("Could not drain the connections within %v, closing them: %v", opts.DrainTimeout, err)
+
+		// Closing the connections cancels the contexts of their requests,
+		// which aborts the renders.
+		if err := closeServer(srv); err != nil {
+			log.Printf("Could not close the server: %v", err)
+		}
+	}
+
+	inFlight.wait()
+
+	log.Print("All requests completed")
+
+	return nil
+}
+
+// HTTPOptions bounds the resources a client may hold. Timeouts of 0 disable
+// the corresponding limit.
+type HTTPOptions struct {
+	// ReadHeaderTimeout is the time allowed to read the request headers.
+	ReadHeaderTimeout time.Duration
+
+	// ReadTimeout is the time allowed to read the whole request.
+	ReadTimeout time.Duration
+
+	// WriteTimeout is the time allowed to write the response, from the end
+	// of the request headers; it must leave room for slow image renders.
+	WriteTimeout time.Duration
+
+	// IdleTimeout is the time a keep-alive connection may wait for the next
+	// request.
+	IdleTimeout time.Duration
+
+	// MaxHeaderBytes is the maximum size of the request headers.
+	MaxHeaderBytes int
+
+	// MaxBodyBytes is the maximum size of a request body; 0 disables the
+	// limit.
+	MaxBodyBytes int64
+}
+
+// ServerOptions configures StartServer.
+type ServerOptions struct {
+	// Addr is the address to listen on; see Listen for the syntax.
+	Addr string
+
+	// DebugAddr is the address of a listener serving the expvar metrics on
+	// /debug/vars, with the syntax of Addr. They include the command line
+	// and memory statistics, so it must not be public; disabled if empty.
+	DebugAddr string
+
+	// Dir is the served directory.
+	Dir string
+
+	// Health holds the checks reported by /readyz, and /health for
+	// compatibility.
+	Health *handlers.HealthRegistry
+
+	HTTP  HTTPOptions
+	Image handlers.ImageOptions
+
+	// MetaHeadersPaths are the URL path prefixes whose images are always
+	// sent with the X-* metadata headers.
+	MetaHeadersPaths []string
+
+	Protocol string
+	Robots   handlers.RobotsOptions
+	Shutdown ShutdownOptions
+	Sitemap  handlers.SitemapOptions
+	TLS      TLSOptions
+
+	// Warm lists the variants rendered into the cache in the background, if
+	// any.
+	Warm WarmOptions
+}
+
+// newHTTPServer returns a server for h on addr, limited by opts.
+func newHTTPServer(addr string, h http.Handler, opts HTTPOptions) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           limitBody(opts.MaxBodyBytes, h),
+		IdleTimeout:       opts.IdleTimeout,
+		MaxHeaderBytes:    opts.MaxHeaderBytes,
+		ReadHeaderTimeout: opts.ReadHeaderTimeout,
+		ReadTimeout:       opts.ReadTimeout,
+		WriteTimeout:      opts.WriteTimeout,
+	}
+}
+
+// StartServer serves opts.Dir on opts.Addr. Once ctx is done, the server
+// shuts down gracefully: readiness goes unhealthy, in-flight requests are
+// drained, then the background tasks, the caches and ImageMagick are stopped,
+// in that order.
+func StartServer(ctx context.Context, opts ServerOptions) error {
+	var certs *certReloader
+
+	if opts.TLS.CertFile != "" {
+		var err error
+
+		if certs, err = newCertReloader(opts.TLS.CertFile, opts.TLS.KeyFile); err != nil {
+			return err
+		}
+	}
+
 	imagick.Initialize()
 	defer imagick.Terminate()
 
+	imageHandler := handlers.NewImage(opts.Dir, opts.Image)
+
+	// The caches are closed once nothing renders images anymore
+	defer func() {
+		imageHandler.Close()
+
+		log.Print("Caches closed")
+	}()
+
+	// Background tasks are stopped once the server is, and before the caches
+	var background sync.WaitGroup
+
+	backgroundCtx, stopBackground := context.WithCancel(context.Background())
+
+	defer func() {
+		stopBackground()
+		background.Wait()
+
+		log.Print("Background tasks stopped")
+	}()
+
+	background.Add(1)
+
+	go func() {
+		defer background.Done()
+		opts.Health.Run(backgroundCtx)
+	}()
+
 	r := mux.NewRouter().Methods(http.MethodGet).Subrouter()
 
-	r.Use(Logger)
+	readiness := handlers.Readiness(opts.Health)
 
-	r.Handle("/health", handlers.Health())
+	r.Handle("/health", readiness)
+	r.Handle("/livez", handlers.Liveness())
+	r.Handle("/readyz", readiness)
 
-	sitemapHandler, err := handlers.Sitemap(dir)
+	sitemapHandler, err := handlers.Sitemap(opts.Dir, opts.Sitemap)
 	if err != nil {
 		return err
 	}
 
-	r.Handle("/sitemap.xml", sitemapHandler)
+	r.Handle("/robots.txt", handlers.Robots(opts.Robots))
+	r.Handle(`/{name:sitemap(?:_index|-[0-9]+)?\.xml(?:\.gz)?}`, sitemapHandler)
 
-	imageHandler := handlers.NewImage(dir, quality)
+	r.Handle("/_gallery", handlers.Gallery(opts.Dir))
+
+	pictureHandler, err := handlers.Picture(opts.Dir)
+	if err != nil {
+		return err
+	}
+
+	r.PathPrefix("/_picture/").Handler(http.StripPrefix("/_picture", pictureHandler))
+
+	imageMetadataHandler := imageHandler.Metadata()
+
+	r.PathPrefix("/_meta/").Handler(http.StripPrefix("/_meta", imageMetadataHandler))
+	r.PathPrefix("/").Queries("format", "json").Handler(imageMetadataHandler)
+
+	if len(opts.Warm.Variants) != 0 {
+		background.Add(1)
+
+		go func() {
+			defer background.Done()
+
+			if err := warm(backgroundCtx, imageHandler, opts.Warm); err != nil {
+				log.Printf("Warm-up failed: %v", err)
+			}
+		}()
+	}
+
+	r.PathPrefix("/").Queries("placeholder", "svg").Handler(imageHandler)
+
+	imageWithMetaHandler := imageHandler.WithMetaHeaders()
+
+	for _, prefix := range opts.MetaHeadersPaths {
+		r.PathPrefix(prefix).
+			HeadersRegexp("Accept", "image/(ico|jpeg|jxr|png|webp)").
+			Handler(imageWithMetaHandler)
+	}
 
 	r.PathPrefix("/").
 		HeadersRegexp("Accept", "image/(ico|jpeg|jxr|png|webp)").
 		Handler(imageHandler)
 
-	return http.ListenAndServe(addr, r)
+	inFlight := newInFlightRequests()
+
+	srv := newHTTPServer(opts.Addr, trackInFlight(inFlight, Logger(Compress(r))), opts.HTTP)
+
+	if certs != nil {
+		srv.TLSConfig = tlsConfig(certs)
+	}
+
+	if err := configureProtocol(srv, opts.Protocol); err != nil {
+		return err
+	}
+
+	ln, err := Listen(opts.Addr)
+	if err != nil {
+		return err
+	}
+
+	var redirectLn net.Listener
+
+	if opts.TLS.RedirectAddr != "" {
+		if redirectLn, err = Listen(opts.TLS.RedirectAddr); err != nil {
+			ln.Close()
+			return err
+		}
+	}
+
+	var debugLn net.Listener
+
+	if opts.DebugAddr != "" {
+		if debugLn, err = Listen(opts.DebugAddr); err != nil {
+			ln.Close()
+
+			if redirectLn != nil {
+				redirectLn.Close()
+			}
+
+			return err
+		}
+	}
+
+	errs := make(chan error, 3)
+
+	go func() {
+		errs <- serve(srv, ln)
+	}()
+
+	if redirectLn != nil {
+		redirect := newHTTPServer(opts.TLS.RedirectAddr, Logger(redirectToHTTPS(opts.Addr)), opts.HTTP)
+
+		// Redirects are cheap: no need to drain them
+		defer redirect.Close()
+
+		go func() {
+			errs <- redirect.Serve(redirectLn)
+		}()
+	}
+
+	if debugLn != nil {
+		debugRouter := mux.NewRouter().Methods(http.MethodGet).Subrouter()
+		debugRouter.Handle("/debug/vars", expvar.Handler())
+
+		debug := newHTTPServer(opts.DebugAddr, Logger(debugRouter), opts.HTTP)
+		defer debug.Close()
+
+		go func() {
+			errs <- debug.Serve(debugLn)
+		}()
+	}
+
+	select {
+	case err := <-errs:
+		closeServer(srv)
+		return err
+	case <-ctx.Done():
+		return shutdown(srv, opts.Health, inFlight, opts.Shutdown)
+	}
 }
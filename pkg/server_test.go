@@ -0,0 +1,168 @@
+package pkg
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"git.quba.fr/qbarrand/quba.fr-server/pkg/handlers"
+)
+
+func Test_inFlightRequests(t *testing.T) {
+	ifr := newInFlightRequests()
+
+	ifr.add(1)
+
+	done := make(chan struct{})
+
+	go func() {
+		ifr.wait()
+		close(done)
+	}()
+
+	// A request starting while waiting is waited for too
+	ifr.add(1)
+	ifr.add(-1)
+
+	select {
+	case <-done:
+		t.Fatal("wait returned with a request in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	ifr.add(-1)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait did not return")
+	}
+}
+
+func Test_shutdown(t *testing.T) {
+	var (
+		health   = &handlers.HealthRegistry{}
+		inFlight = newInFlightRequests()
+		started  = make(chan struct{})
+		release  = make(chan struct{})
+	)
+
+	mux := http.NewServeMux()
+	mux.Handle("/readyz", handlers.Readiness(health))
+	mux.HandleFunc("/render", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+
+	srv := newHTTPServer("", trackInFlight(inFlight, mux), HTTPOptions{})
+
+	ln, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go serve(srv, ln)
+	defer srv.Close()
+
+	base := "http://" + ln.Addr().String()
+
+	// A new connection for every request
+	client := http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+	rendered := make(chan error, 1)
+
+	go func() {
+		res, err := client.Get(base + "/render")
+		if err == nil {
+			res.Body.Close()
+		}
+
+		rendered <- err
+	}()
+
+	<-started
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- shutdown(srv, health, inFlight, ShutdownOptions{Delay: 300 * time.Millisecond, DrainTimeout: 10 * time.Second})
+	}()
+
+	// First, readiness goes unhealthy while connections are still accepted
+	for !health.Draining() {
+		time.Sleep(time.Millisecond)
+	}
+
+	res, err := client.Get(base + "/readyz")
+	if err != nil {
+		t.Fatalf("The listener closed before the delay: %v", err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Readiness: got HTTP %d", res.StatusCode)
+	}
+
+	// Then, the listener closes while the render is drained
+	time.Sleep(400 * time.Millisecond)
+
+	if res, err := client.Get(base + "/readyz"); err == nil {
+		res.Body.Close()
+		t.Fatal("The listener should be closed")
+	}
+
+	select {
+	case <-done:
+		t.Fatal("shutdown returned before the render completed")
+	default:
+	}
+
+	close(release)
+
+	if err := <-rendered; err != nil {
+		t.Fatalf("The render was not drained: %v", err)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_limitBody(t *testing.T) {
+	h := limitBody(8, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := ioutil.ReadAll(r.Body); err != nil {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		}
+	}))
+
+	cases := []struct {
+		name          string
+		body          io.Reader
+		contentLength int64
+		expected      int
+	}{
+		{name: "small body", body: strings.NewReader("12345678"), contentLength: 8, expected: http.StatusOK},
+		{name: "declared large body", body: strings.NewReader("123456789"), contentLength: 9, expected: http.StatusRequestEntityTooLarge},
+		// Chunked bodies have no Content-Length
+		{name: "undeclared large body", body: strings.NewReader("123456789"), contentLength: -1, expected: http.StatusRequestEntityTooLarge},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/", c.body)
+			req.ContentLength = c.contentLength
+
+			w := httptest.NewRecorder()
+
+			h.ServeHTTP(w, req)
+
+			if res := w.Result(); res.StatusCode != c.expected {
+				t.Fatalf("Expected HTTP %d, got %d", c.expected, res.StatusCode)
+			}
+		})
+	}
+}
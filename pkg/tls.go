@@ -0,0 +1,163 @@
+package pkg
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// certCheckInterval is the minimum time between two checks of the
+// certificate files for changes.
+const certCheckInterval = 10 * time.Second
+
+// TLSOptions configures TLS. It is disabled if CertFile is empty.
+type TLSOptions struct {
+	CertFile string
+	KeyFile  string
+
+	// RedirectAddr is the address of a plain HTTP listener redirecting to
+	// HTTPS; disabled if empty.
+	RedirectAddr string
+}
+
+// certReloader serves the certificate in certFile and keyFile, and reloads it
+// when either file changes on disk, e.g. after a renewal. If the new files
+// cannot be loaded, the previous certificate is kept.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	cert          *tls.Certificate
+	checkInterval time.Duration
+	lastCheck     time.Time
+	modTimes      [2]time.Time
+
+	m sync.Mutex
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{
+		certFile:      certFile,
+		keyFile:       keyFile,
+		checkInterval: certCheckInterval,
+	}
+
+	modTimes, err := cr.stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cr.load(modTimes); err != nil {
+		return nil, err
+	}
+
+	cr.lastCheck = time.Now()
+
+	return cr, nil
+}
+
+// stat returns the modification times of the certificate and key files.
+func (cr *certReloader) stat() ([2]time.Time, error) {
+	var modTimes [2]time.Time
+
+	for i, path := range []string{cr.certFile, cr.keyFile} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return modTimes, err
+		}
+
+		modTimes[i] = fi.ModTime()
+	}
+
+	return modTimes, nil
+}
+
+func (cr *certReloader) load(modTimes [2]time.Time) error {
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("could not load the certificate: %v", err)
+	}
+
+	cr.cert = &cert
+	cr.modTimes = modTimes
+
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.m.Lock()
+	defer cr.m.Unlock()
+
+	if time.Since(cr.lastCheck) < cr.checkInterval {
+		return cr.cert, nil
+	}
+
+	cr.lastCheck = time.Now()
+
+	modTimes, err := cr.stat()
+	if err != nil {
+		log.Printf("Could not check the certificate files, keeping the current certificate: %v", err)
+		return cr.cert, nil
+	}
+
+	if modTimes == cr.modTimes {
+		return cr.cert, nil
+	}
+
+	// A pair written halfway does not load; it is retried on the next check
+	if err := cr.load(modTimes); err != nil {
+		log.Printf("Keeping the current certificate: %v", err)
+	} else {
+		log.Printf("Reloaded the certificate from %s", cr.certFile)
+	}
+
+	return cr.cert, nil
+}
+
+// tlsConfig returns a configuration restricted to TLS 1.2 and later, with
+// forward-secret AEAD cipher suites only.
+func tlsConfig(cr *certReloader) *tls.Config {
+	return &tls.Config{
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+		},
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+		GetCertificate:   cr.GetCertificate,
+		MinVersion:       tls.VersionTLS12,
+	}
+}
+
+// redirectToHTTPS returns a handler redirecting permanently to the same URL
+// over HTTPS, on the port of tlsAddr.
+func redirectToHTTPS(tlsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(tlsAddr)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+
+		u := *r.URL
+		u.Scheme = "https"
+		u.Host = host
+
+		http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+	})
+}
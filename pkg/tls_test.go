@@ -0,0 +1,195 @@
+package pkg
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeSelfSigned writes a self-signed certificate for localhost with the
+// given common name, and its key, to certFile and keyFile.
+func writeSelfSigned(t *testing.T, certFile, keyFile, commonName string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func commonName(t *testing.T, cert *tls.Certificate) string {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return leaf.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	writeSelfSigned(t, certFile, keyFile, "first")
+
+	cr, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cr.checkInterval = 0
+
+	get := func(t *testing.T) string {
+		cert, err := cr.GetCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return commonName(t, cert)
+	}
+
+	if name := get(t); name != "first" {
+		t.Fatalf("Unexpected certificate %q", name)
+	}
+
+	// Make sure that the modification times change
+	touch := func(t *testing.T, when time.Time) {
+		for _, path := range []string{certFile, keyFile} {
+			if err := os.Chtimes(path, when, when); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	t.Run("reloaded on change", func(t *testing.T) {
+		writeSelfSigned(t, certFile, keyFile, "second")
+		touch(t, time.Now().Add(time.Minute))
+
+		if name := get(t); name != "second" {
+			t.Fatalf("Unexpected certificate %q", name)
+		}
+	})
+
+	t.Run("kept if invalid", func(t *testing.T) {
+		if err := ioutil.WriteFile(keyFile, []byte("garbage"), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		touch(t, time.Now().Add(2*time.Minute))
+
+		if name := get(t); name != "second" {
+			t.Fatalf("Unexpected certificate %q", name)
+		}
+	})
+
+	t.Run("serves HTTPS", func(t *testing.T) {
+		writeSelfSigned(t, certFile, keyFile, "third")
+		touch(t, time.Now().Add(3*time.Minute))
+
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		srv.TLS = tlsConfig(cr)
+		srv.StartTLS()
+		defer srv.Close()
+
+		conn, err := tls.Dial("tcp", srv.Listener.Addr().String(), &tls.Config{InsecureSkipVerify: true, ServerName: "localhost"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		state := conn.ConnectionState()
+
+		if state.Version < tls.VersionTLS12 {
+			t.Fatalf("Negotiated version %x", state.Version)
+		}
+
+		if name := state.PeerCertificates[0].Subject.CommonName; name != "third" {
+			t.Fatalf("Unexpected certificate %q", name)
+		}
+	})
+
+	t.Run("TLS 1.1 refused", func(t *testing.T) {
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		srv.TLS = tlsConfig(cr)
+		srv.StartTLS()
+		defer srv.Close()
+
+		cfg := &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS11}
+
+		if conn, err := tls.Dial("tcp", srv.Listener.Addr().String(), cfg); err == nil {
+			conn.Close()
+			t.Fatal("Expected the handshake to fail")
+		}
+	})
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	cases := []struct {
+		tlsAddr  string
+		url      string
+		expected string
+	}{
+		{tlsAddr: ":443", url: "http://example.com/a/b.jpg?w=1", expected: "https://example.com/a/b.jpg?w=1"},
+		{tlsAddr: ":8443", url: "http://example.com:8080/", expected: "https://example.com:8443/"},
+	}
+
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+
+		redirectToHTTPS(c.tlsAddr).ServeHTTP(w, httptest.NewRequest(http.MethodGet, c.url, nil))
+
+		res := w.Result()
+
+		if res.StatusCode != http.StatusMovedPermanently {
+			t.Fatalf("Got HTTP %d", res.StatusCode)
+		}
+
+		if loc := res.Header.Get("Location"); loc != c.expected {
+			t.Fatalf("%s: expected %s, got %s", c.url, c.expected, loc)
+		}
+	}
+}
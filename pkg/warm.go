@@ -0,0 +1,56 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"gopkg.in/gographics/imagick.v2/imagick"
+
+	"git.quba.fr/qbarrand/quba.fr-server/pkg/handlers"
+)
+
+// WarmOptions configures the rendering of image variants ahead of requests.
+type WarmOptions struct {
+	Concurrency int
+	Variants    []handlers.Variant
+}
+
+// warm renders the variants of opts with i, and logs the progress.
+func warm(ctx context.Context, i *handlers.Image, opts WarmOptions) error {
+	start := time.Now()
+
+	log.Printf("Warming up %d variants per image with %d workers", len(opts.Variants), opts.Concurrency)
+
+	failed, err := i.Warm(ctx, opts.Variants, opts.Concurrency, func(p handlers.WarmProgress) {
+		switch {
+		case p.Err != nil:
+			log.Printf("[%d/%d] Could not render %s as %s: %v", p.Done, p.Total, p.Path, p.Variant, p.Err)
+		case p.Cached:
+			log.Printf("[%d/%d] %s as %s: already cached", p.Done, p.Total, p.Path, p.Variant)
+		default:
+			log.Printf("[%d/%d] Rendered %s as %s", p.Done, p.Total, p.Path, p.Variant)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Warm-up finished in %v", time.Since(start))
+
+	if failed != 0 {
+		return fmt.Errorf("%d variants could not be rendered", failed)
+	}
+
+	return nil
+}
+
+// Warm renders variants of every image in dir into the cache directory of
+// imageOpts.
+func Warm(dir string, imageOpts handlers.ImageOptions, opts WarmOptions) error {
+	imagick.Initialize()
+	defer imagick.Terminate()
+
+	return warm(context.Background(), handlers.NewImage(dir, imageOpts), opts)
+}